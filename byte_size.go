@@ -0,0 +1,40 @@
+package main
+
+import "errors"
+import "math"
+import "strconv"
+import "strings"
+
+var byteSizeSuffixes = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// ParseByteSize parses a number of bytes, optionally followed by a K, M, G, or T suffix.  An
+// empty string is treated as zero, which we use to mean no limit.
+func ParseByteSize(str string) (int64, error) {
+	str = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(str)), "B")
+	if str == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	if m, ok := byteSizeSuffixes[str[len(str)-1]]; ok {
+		multiplier = m
+		str = str[:len(str)-1]
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("size must not be negative")
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, errors.New("size is too large")
+	}
+	return n * multiplier, nil
+}
@@ -50,8 +50,14 @@ func (tracker *ConnectionTracker) track() {
 		case timeout := <-tracker.shutdown:
 			deadline = timeout.C
 
+			// stop reading more requests, but let the current responses finish; TLS connections
+			// can't be half-closed, so make their next read time out instead
 			for nc := range connections {
-				nc.(*net.TCPConn).CloseRead()
+				if tc, ok := nc.(*net.TCPConn); ok {
+					tc.CloseRead()
+				} else {
+					nc.SetReadDeadline(time.Now())
+				}
 			}
 
 		case <-deadline:
@@ -6,5 +6,17 @@ const DefaultListenAddress = "0.0.0.0"
 const DefaultPort = "8080"
 
 const ProxyTimeout = 15
+const MaxRedirects = 10
+
+const DefaultMaxGitRequestSize = "16M"
+
+const DefaultAPKIndexTTL = 300
+const DefaultGoModuleListTTL = 300
+const DefaultNPMMetadataTTL = 300
+const DefaultPyPIIndexTTL = 300
+const DefaultOCITagTTL = 300
+const DefaultMavenMetadataTTL = 300
+
+const TLSReloadCheckInterval = 10
 
 const ShutdownResponseTimeout = 15
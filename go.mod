@@ -0,0 +1,10 @@
+module github.com/willbryant/proximate
+
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/tinylib/msgp v1.1.0
+)
+
+require github.com/philhofer/fwd v1.1.1 // indirect
@@ -3,16 +3,19 @@ package main
 import "io"
 import "net/http"
 import "os"
+import "github.com/willbryant/proximate/response_cache"
 
 type healthCheckServer struct {
 	HealthyIfFile     string
 	HealthyUnlessFile string
+	Cache             response_cache.ResponseCache
 }
 
-func HealthCheckServer(healthyIfFile string, healthyUnlessFile string) healthCheckServer {
+func HealthCheckServer(healthyIfFile string, healthyUnlessFile string, cache response_cache.ResponseCache) healthCheckServer {
 	return healthCheckServer{
 		HealthyIfFile:     AddRoot(healthyIfFile),
 		HealthyUnlessFile: AddRoot(healthyUnlessFile),
+		Cache:             cache,
 	}
 }
 
@@ -41,6 +44,14 @@ func (server healthCheckServer) ServeHTTP(w http.ResponseWriter, req *http.Reque
 		}
 	}
 
+	// we can still proxy requests if the cache is degraded, so we don't want the load balancer to
+	// take us out of service, but we do want to make the problem visible
+	if err := server.Cache.Health(); err != nil {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "Online, "+err.Error()+"\n")
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, "Online\n")
 }
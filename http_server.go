@@ -1,7 +1,11 @@
 package main
 
+import "crypto/tls"
+import "errors"
+import "fmt"
 import "net"
 import "net/http"
+import "os"
 import "sync/atomic"
 import "time"
 
@@ -26,16 +30,44 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
+// Serve serves requests on the listener, using TLS if we've been given a certificate, and on the
+// plain HTTP listener if there is one, until the server is shut down.
 func (server proximateServer) Serve() error {
+	if server.PlainListener != nil {
+		go func() {
+			// closing the listener when we shut down makes serveListener return an error too
+			if err := server.serveListener(tcpKeepAliveListener{server.PlainListener.(*net.TCPListener)}); !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "Stopped serving plain HTTP requests: %s\n", err)
+			}
+		}()
+	}
+	if server.TLSConfig != nil {
+		return server.serveListener(tls.NewListener(tcpKeepAliveListener{server.Listener.(*net.TCPListener)}, server.TLSConfig))
+	}
+	return server.serveListener(tcpKeepAliveListener{server.Listener.(*net.TCPListener)})
+}
+
+func (server proximateServer) serveListener(listener net.Listener) error {
 	srv := &http.Server{
 		ConnState: server.Tracker.ConnState,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// CONNECT requests have no path, so ServeMux won't route them to us
+			if req.Method == "CONNECT" {
+				server.ServeHTTP(w, req)
+			} else {
+				http.DefaultServeMux.ServeHTTP(w, req)
+			}
+		}),
 	}
-	return srv.Serve(tcpKeepAliveListener{server.Listener.(*net.TCPListener)})
+	return srv.Serve(listener)
 }
 
 func (server proximateServer) Shutdown() {
 	atomic.StoreUint32(&server.Closed, 1)
 	server.Listener.Close()
+	if server.PlainListener != nil {
+		server.PlainListener.Close()
+	}
 }
 
 func (server proximateServer) Active() bool {
@@ -0,0 +1,235 @@
+package main
+
+import "crypto"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "errors"
+import "fmt"
+import "io"
+import "math/big"
+import "net"
+import "net/http"
+import "os"
+import "strings"
+import "sync"
+import "time"
+
+// how long the certificates we make for intercepted servers are valid for; we make new ones when
+// they're within a day of expiring
+const interceptedCertificateLifetime = 7 * 24 * time.Hour
+
+// CertificateAuthority makes certificates for the servers we intercept tunnels to, signed by a
+// CA that the clients trust.
+type CertificateAuthority struct {
+	certificate  *x509.Certificate
+	key          crypto.Signer
+	mutex        sync.Mutex
+	certificates map[string]*tls.Certificate
+}
+
+func LoadCertificateAuthority(certFile string, keyFile string) (*CertificateAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !certificate.IsCA {
+		return nil, errors.New("the certificate isn't a CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("the key can't be used for signing")
+	}
+	return &CertificateAuthority{
+		certificate:  certificate,
+		key:          key,
+		certificates: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// certificateFor returns a certificate for the server, making a new one if we don't already have
+// one that's good for at least another day.
+func (ca *CertificateAuthority) certificateFor(host string) (*tls.Certificate, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if certificate, ok := ca.certificates[host]; ok && time.Until(certificate.Leaf.NotAfter) > 24*time.Hour {
+		return certificate, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(interceptedCertificateLifetime)
+	if notAfter.After(ca.certificate.NotAfter) {
+		notAfter = ca.certificate.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate := &tls.Certificate{
+		Certificate: [][]byte{der, ca.certificate.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	ca.certificates[host] = certificate
+	return certificate, nil
+}
+
+// shouldIntercept returns true if we've been given a CA to intercept tunnels with, and the server
+// is listed in the cache rules, so we might be able to cache some of its responses.
+func (server proximateServer) shouldIntercept(hostport string) bool {
+	return server.Interceptor != nil && server.Rules.HostListed(tunnelURLHost(hostport))
+}
+
+// tunnelURLHost returns the host:port that a tunnel is opened to in the form it would appear in an
+// https URL, without the port if it's the default, which is how servers are listed in the rules.
+func tunnelURLHost(hostport string) string {
+	return strings.TrimSuffix(strings.ToLower(hostport), ":443")
+}
+
+// interceptTunnel handles CONNECT requests by pretending to be the requested server, using a
+// certificate signed by our CA, so that we can see the requests sent through the tunnel and
+// serve them like any other request, caching them if they match the cache rules.
+func (server proximateServer) interceptTunnel(rw http.ResponseWriter, req *http.Request) {
+	urlHost := tunnelURLHost(req.Host)
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid tunnel address %s", req.Host), http.StatusBadRequest)
+		return
+	}
+	certificate, err := server.Interceptor.certificateFor(strings.ToLower(host))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Couldn't make a certificate for %s: %s", host, err), http.StatusInternalServerError)
+		return
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "Tunnels aren't supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "couldn't take over connection for tunnel to %s: %s\n", req.Host, err)
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		client.Close()
+		return
+	}
+
+	// the client may have sent the start of its TLS handshake along with the CONNECT request, so
+	// read from the buffer first
+	conn := tls.Server(bufferedConn{Conn: client, reader: buffered.Reader}, &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		NextProtos:   []string{"http/1.1"},
+	})
+	// track the connection like the one it came in on, so that shutting down waits for the requests
+	// sent through the tunnel
+	listener := newOneConnListener(conn)
+	srv := &http.Server{
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			server.Tracker.ConnState(conn, state)
+			listener.ConnState(conn, state)
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// requests through the tunnel only have a path; they can only go to the server the
+			// tunnel was opened to, whatever their Host header says
+			req.URL.Scheme = "https"
+			req.URL.Host = urlHost
+			req.Host = urlHost
+			server.ServeHTTP(w, req)
+		}),
+	}
+	srv.Serve(listener)
+}
+
+// oneConnListener is a net.Listener that accepts just the one connection, so that we can use
+// http.Server to serve the requests sent through an intercepted tunnel.
+type oneConnListener struct {
+	conn   chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	addr   net.Addr
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	listener := &oneConnListener{
+		conn:   make(chan net.Conn, 1),
+		closed: make(chan struct{}),
+		addr:   conn.LocalAddr(),
+	}
+	listener.conn <- conn
+	return listener
+}
+
+func (listener *oneConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conn:
+		return conn, nil
+	case <-listener.closed:
+		return nil, io.EOF
+	}
+}
+
+// ConnState stops the listener once the connection has been closed, which makes http.Server
+// return.
+func (listener *oneConnListener) ConnState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		listener.Close()
+	}
+}
+
+func (listener *oneConnListener) Close() error {
+	listener.once.Do(func() { close(listener.closed) })
+	return nil
+}
+
+func (listener *oneConnListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// bufferedConn is a connection that reads from a buffer holding data already read from it, such as
+// the one the HTTP server read a CONNECT request into, before reading from the connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
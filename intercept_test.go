@@ -0,0 +1,194 @@
+package main
+
+import "testing"
+
+import "bufio"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "io"
+import "io/ioutil"
+import "math/big"
+import "net"
+import "net/http"
+import "strings"
+import "time"
+
+func testCertificateAuthority(t *testing.T, lifetime time.Duration) *CertificateAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CertificateAuthority{
+		certificate:  certificate,
+		key:          key,
+		certificates: make(map[string]*tls.Certificate),
+	}
+}
+
+func assertCertificateValidFor(t *testing.T, ca *CertificateAuthority, certificate *tls.Certificate, host string) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	if _, err := certificate.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+		t.Errorf("expected the certificate to be valid for %s, got %s", host, err)
+	}
+}
+
+func TestCertificateFor(t *testing.T) {
+	ca := testCertificateAuthority(t, 365*24*time.Hour)
+
+	for _, host := range []string{"github.com", "127.0.0.1", "::1"} {
+		certificate, err := ca.certificateFor(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertCertificateValidFor(t, ca, certificate, host)
+		if len(certificate.Certificate) != 2 || !certificate.Leaf.NotAfter.After(time.Now().Add(interceptedCertificateLifetime-time.Hour)) {
+			t.Errorf("expected a certificate chain valid for %s, got %d certificates valid until %s", interceptedCertificateLifetime, len(certificate.Certificate), certificate.Leaf.NotAfter)
+		}
+
+		// the same certificate should be used again
+		if again, _ := ca.certificateFor(host); again != certificate {
+			t.Errorf("expected the certificate for %s to be reused", host)
+		}
+	}
+
+	other, _ := ca.certificateFor("gitlab.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	if _, err := other.Leaf.Verify(x509.VerifyOptions{DNSName: "github.com", Roots: roots}); err == nil {
+		t.Error("expected the certificate for one server not to be valid for another")
+	}
+}
+
+func TestCertificateForRenewsExpiringCertificates(t *testing.T) {
+	ca := testCertificateAuthority(t, 365*24*time.Hour)
+	certificate, _ := ca.certificateFor("github.com")
+	certificate.Leaf.NotAfter = time.Now().Add(23 * time.Hour)
+
+	renewed, err := ca.certificateFor("github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == certificate {
+		t.Error("expected a certificate that expires within a day to be replaced")
+	}
+	assertCertificateValidFor(t, ca, renewed, "github.com")
+}
+
+func TestCertificateForDoesNotOutliveTheCA(t *testing.T) {
+	ca := testCertificateAuthority(t, 3*24*time.Hour)
+	certificate, err := ca.certificateFor("github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Leaf.NotAfter.After(ca.certificate.NotAfter) {
+		t.Errorf("expected the certificate to expire with the CA at %s, got %s", ca.certificate.NotAfter, certificate.Leaf.NotAfter)
+	}
+	assertCertificateValidFor(t, ca, certificate, "github.com")
+}
+
+func TestOneConnListener(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	listener := newOneConnListener(server)
+
+	if conn, err := listener.Accept(); conn != server || err != nil {
+		t.Fatalf("expected the connection, got %v %v", conn, err)
+	}
+	if listener.Addr() != server.LocalAddr() {
+		t.Errorf("expected the connection's address, got %v", listener.Addr())
+	}
+
+	// the next Accept should wait until the connection has been closed
+	accepted := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	listener.ConnState(server, http.StateActive)
+	listener.ConnState(server, http.StateIdle)
+	select {
+	case err := <-accepted:
+		t.Fatalf("expected Accept to wait, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	listener.ConnState(server, http.StateClosed)
+	select {
+	case err := <-accepted:
+		if err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Accept to return once the connection was closed")
+	}
+
+	// closing again is harmless
+	listener.ConnState(server, http.StateHijacked)
+	if err := listener.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOneConnListenerServesRequests(t *testing.T) {
+	client, server := net.Pipe()
+	listener := newOneConnListener(server)
+	srv := &http.Server{
+		ConnState: listener.ConnState,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "Test response body.")
+		}),
+	}
+	served := make(chan error)
+	go func() { served <- srv.Serve(listener) }()
+
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "Test response body." {
+		t.Errorf("expected the response, got %q", body)
+	}
+	client.Close()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("expected the server to stop once the connection was closed")
+	}
+}
+
+func TestBufferedConnReadsBufferFirst(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := bufferedConn{Conn: server, reader: io.MultiReader(strings.NewReader("buffered "), server)}
+	go io.WriteString(client, "unbuffered")
+	data := make([]byte, len("buffered unbuffered"))
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "buffered unbuffered" {
+		t.Errorf("expected the buffered data first, got %q %v", data, err)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path"
+import "github.com/willbryant/proximate/response_cache"
+import "strings"
+import "sync"
+import "time"
+
+// the built-in rules for the kinds of requests that we know how to cache; each is only used if
+// a list of upstream servers is given for it.  package files are the same whichever client asks
+// for them, so most of the rules leave the request headers out of the cache key.
+
+// git upload-pack requests that ask for specific objects always get the same pack back, but
+// protocol v2 also sends ls-refs commands to the same URL, so we have to look at the body.  the
+// key ignores the client's git version and the order of the body, so different clients share.
+// big repositories can make for big requests, so the size limit is configurable.
+func gitPackRule(upstreams string, maxRequestSize int64) response_cache.CacheRule {
+	return response_cache.CacheRule{
+		Name:    "git-packs",
+		Methods: []string{"POST"},
+		Hosts:   strings.Split(upstreams, ","),
+		RequiredHeaders: map[string]string{
+			"Content-Type": "application/x-git-upload-pack-request",
+			"Accept":       "application/x-git-upload-pack-result",
+		},
+		ForbiddenHeaders:   []string{"Cache-Control", "Authorization"},
+		MaxRequestBodySize: maxRequestSize,
+		Match:              response_cache.CacheableGitUploadPack,
+		KeyFunction:        response_cache.GitUploadPackKey,
+	}
+}
+
+func debPoolRule(upstreams string) response_cache.CacheRule {
+	return response_cache.CacheRule{
+		Name:             "deb-pools",
+		Methods:          []string{"GET", "HEAD"},
+		Hosts:            strings.Split(upstreams, ","),
+		PathRegexp:       `/pool/.*\.deb$`,
+		ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+		KeyHeaders:       []string{},
+	}
+}
+
+// rpm packages and the checksum-named repodata files are never changed once published, so we
+// can cache them indefinitely.  repomd.xml is deliberately not matched - it's what tells clients
+// the names of the current repodata files, so it's always proxied to the upstream server.
+func rpmRepoRule(upstreams string) response_cache.CacheRule {
+	return response_cache.CacheRule{
+		Name:             "rpm-repos",
+		Methods:          []string{"GET", "HEAD"},
+		Hosts:            strings.Split(upstreams, ","),
+		PathRegexp:       `(\.rpm|/repodata/[0-9a-f]{32,}-[^/]+)$`,
+		ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+		KeyHeaders:       []string{},
+	}
+}
+
+// apk packages are immutable, but the APKINDEX lists the current packages, so we only cache it
+// briefly; once it has expired, we ask the server whether it has changed using its ETag and
+// Last-Modified headers, and keep using our copy if it hasn't.
+func apkRepoRules(upstreams string, indexTTL time.Duration) []response_cache.CacheRule {
+	return []response_cache.CacheRule{
+		{
+			Name:             "apk-repos",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `\.apk$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{},
+		},
+		{
+			Name:             "apk-indexes",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `/APKINDEX\.tar\.gz$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{},
+			TTL:              response_cache.Duration{Duration: indexTTL},
+		},
+	}
+}
+
+// module versions served by a GOPROXY are immutable, but the version lists change as new versions
+// are published, and queries for branches and commits resolve to new versions as they're pushed,
+// so we only cache those briefly.  sumdb requests aren't matched, so they're always proxied.
+func goModuleRules(upstreams string, listTTL time.Duration) []response_cache.CacheRule {
+	return []response_cache.CacheRule{
+		{
+			Name:             "go-modules",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `/@v/v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z!.-]+)?(\+incompatible)?\.(zip|mod|info)$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{},
+		},
+		{
+			Name:             "go-module-lists",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `/(@v/list|@v/[^/]+\.info|@latest)$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{},
+			TTL:              response_cache.Duration{Duration: listTTL},
+		},
+	}
+}
+
+// npm package tarballs are immutable, but package documents list the current versions, so we
+// only cache those briefly, then revalidate them.  npm sends a random npm-session header and
+// other noise with every request, so only the headers that change the response go in the key.
+// if we know our public URL, we point the tarball URLs in package documents back through
+// proximate, otherwise clients fetch the tarballs straight from the registry.
+func npmRegistryRules(upstreams string, metadataTTL time.Duration, publicURL string) []response_cache.CacheRule {
+	rules := []response_cache.CacheRule{
+		{
+			Name:             "npm-tarballs",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `/-/[^/]+\.tgz$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{"Accept-Encoding"},
+		},
+		{
+			Name:             "npm-packages",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{"Accept", "Accept-Encoding"},
+			TTL:              response_cache.Duration{Duration: metadataTTL},
+			Match: func(req *http.Request) bool {
+				// the registry's own endpoints, like search, are all under /-/
+				return !strings.Contains(req.URL.Path, "/-/") && !strings.HasSuffix(req.URL.Path, "/")
+			},
+		},
+	}
+
+	if publicURL != "" {
+		// rewritten documents are fetched uncompressed, so they're the same whatever encodings the
+		// client accepts
+		rules[1].KeyHeaders = []string{"Accept"}
+		rules[1].Rewrite = func(req *http.Request, res *http.Response, fetch func(*http.Request) (*http.Response, error)) {
+			response_cache.ReplaceInResponse(res,
+				`"tarball":"https://`+req.URL.Host+`/`,
+				`"tarball":"`+publicURL+`/`+req.URL.Host+`/`)
+		}
+	}
+	return rules
+}
+
+// PyPI package files have a hash of their content in their URLs, so they're immutable, but the
+// index pages list the current files, so we only cache those briefly, then revalidate them.  pip
+// sends Cache-Control: max-age=0 with its index requests, so we can't refuse to cache those.  if
+// we know our public URL, we point the file links in the index pages back through proximate.
+func pypiRules(indexUpstreams string, fileUpstreams string, indexTTL time.Duration, publicURL string) []response_cache.CacheRule {
+	var rules []response_cache.CacheRule
+	if fileUpstreams != "" {
+		rules = append(rules, response_cache.CacheRule{
+			Name:             "pypi-files",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(fileUpstreams, ","),
+			PathRegexp:       `/packages/.+[^/]$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{"Accept-Encoding"},
+		})
+	}
+
+	if indexUpstreams != "" {
+		rule := response_cache.CacheRule{
+			Name:             "pypi-indexes",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(indexUpstreams, ","),
+			PathRegexp:       `^(/simple/|/pypi/.+/json$)`,
+			ForbiddenHeaders: []string{"Authorization"},
+			KeyHeaders:       []string{"Accept", "Accept-Encoding"},
+			TTL:              response_cache.Duration{Duration: indexTTL},
+		}
+
+		if publicURL != "" && fileUpstreams != "" {
+			// rewritten pages are fetched uncompressed, so they're the same whatever encodings the
+			// client accepts
+			rule.KeyHeaders = []string{"Accept"}
+			rule.Rewrite = func(req *http.Request, res *http.Response, fetch func(*http.Request) (*http.Response, error)) {
+				for _, upstream := range strings.Split(fileUpstreams, ",") {
+					// we can only rewrite links to servers that we know the name of
+					host := strings.SplitN(upstream, "/", 2)[0]
+					if !strings.Contains(host, "*") {
+						response_cache.ReplaceInResponse(res, "https://"+host+"/", publicURL+"/"+host+"/")
+					}
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// OCI registry blobs and manifests fetched by digest are immutable, and we verify their digest,
+// so they can be cached even though clients always send credentials, and shared between
+// repositories.  blobs are often served by redirecting to a CDN, so we follow those redirects.
+// tags can be moved, so we only cache those briefly, then revalidate them, and we don't cache
+// tag lookups sent with credentials.
+func ociRegistryRules(upstreams string, tagTTL time.Duration) []response_cache.CacheRule {
+	return []response_cache.CacheRule{
+		{
+			Name:             "oci-blobs",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `^/v2/.+/blobs/sha256:[0-9a-f]{64}$`,
+			ForbiddenHeaders: []string{"Cache-Control"},
+			FollowRedirects:  true,
+			KeyFunction:      digestKey("blob"),
+			Rewrite:          verifyDigest,
+		},
+		{
+			Name:             "oci-manifests",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `^/v2/.+/manifests/sha256:[0-9a-f]{64}$`,
+			ForbiddenHeaders: []string{"Cache-Control"},
+			FollowRedirects:  true,
+			KeyFunction:      digestKey("manifest"),
+			Rewrite:          verifyDigest,
+		},
+		{
+			Name:             "oci-tags",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `^/v2/.+/manifests/[^/:]+$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{"Accept"},
+			TTL:              response_cache.Duration{Duration: tagTTL},
+		},
+	}
+}
+
+// digestKey returns a function that keys requests by the digest at the end of their path alone.
+func digestKey(kind string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		return response_cache.HashString(kind + "\x00" + path.Base(req.URL.Path))
+	}
+}
+
+func verifyDigest(req *http.Request, res *http.Response, fetch func(*http.Request) (*http.Response, error)) {
+	response_cache.VerifyDigest(res, "sha256", strings.TrimPrefix(path.Base(req.URL.Path), "sha256:"))
+}
+
+// maven release artifacts are never changed once published, but metadata files and snapshots
+// are, so we only cache those briefly, then revalidate them.  optionally, we check each artifact
+// against the .sha1 file that the repository publishes alongside it before caching it.
+func mavenRepoRules(upstreams string, metadataTTL time.Duration, verifyChecksums bool) []response_cache.CacheRule {
+	rules := []response_cache.CacheRule{
+		{
+			Name:             "maven-metadata",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `(/maven-metadata\.xml|-SNAPSHOT/[^/]+)$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{},
+			TTL:              response_cache.Duration{Duration: metadataTTL},
+		},
+		{
+			Name:             "maven-artifacts",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `\.(jar|pom|module)$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{},
+		},
+		{
+			Name:             "maven-checksums",
+			Methods:          []string{"GET", "HEAD"},
+			Hosts:            strings.Split(upstreams, ","),
+			PathRegexp:       `\.(jar|pom|module)\.(sha1|sha256|sha512|md5)$`,
+			ForbiddenHeaders: []string{"Cache-Control", "Authorization"},
+			KeyHeaders:       []string{},
+		},
+	}
+
+	if verifyChecksums {
+		rules[1].Rewrite = verifyMavenChecksum
+	}
+	return rules
+}
+
+// verifyMavenChecksum fetches the .sha1 file for the artifact while the artifact is being
+// downloaded, and if there is one, makes the response fail if the artifact doesn't match it.
+func verifyMavenChecksum(req *http.Request, res *http.Response, fetch func(*http.Request) (*http.Response, error)) {
+	checksumReq, err := http.NewRequest("GET", req.URL.String()+".sha1", nil)
+	if err != nil {
+		return
+	}
+
+	checksum := make(chan string, 1)
+	go func() {
+		checksum <- fetchMavenChecksum(req, checksumReq, fetch)
+	}()
+
+	var once sync.Once
+	var expected string
+	response_cache.VerifyDigestLater(res, "sha1", func() string {
+		once.Do(func() { expected = <-checksum })
+		return expected
+	})
+}
+
+// fetchMavenChecksum returns the checksum in the .sha1 file, or an empty string if there isn't one.
+func fetchMavenChecksum(req *http.Request, checksumReq *http.Request, fetch func(*http.Request) (*http.Response, error)) string {
+	checksumRes, err := fetch(checksumReq)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "couldn't fetch checksum for %s, caching without verifying: %s\n", req.URL, err)
+		return ""
+	}
+	defer checksumRes.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(checksumRes.Body, 1024))
+	if checksumRes.StatusCode != http.StatusOK || err != nil {
+		fmt.Fprintf(os.Stdout, "couldn't fetch checksum for %s, caching without verifying: %s\n", req.URL, checksumRes.Status)
+		return ""
+	}
+
+	// some repositories put the file name after the checksum
+	if fields := strings.Fields(string(body)); len(fields) > 0 && len(fields[0]) == 40 {
+		return fields[0]
+	}
+	return ""
+}
+
+// presetUpstreams gives the upstream servers to use each built-in rule for, and their settings.
+type presetUpstreams struct {
+	gitPacks      string
+	debPools      string
+	rpmRepos      string
+	apkRepos      string
+	goModules     string
+	npmRegistries string
+	pypiIndexes   string
+	pypiFiles     string
+	ociRegistries string
+	mavenRepos    string
+
+	maxGitRequestSize int64
+
+	apkIndexTTL      time.Duration
+	goModuleListTTL  time.Duration
+	npmMetadataTTL   time.Duration
+	pypiIndexTTL     time.Duration
+	ociTagTTL        time.Duration
+	mavenMetadataTTL time.Duration
+
+	verifyMavenChecksums bool
+
+	// the URL that clients use to reach proximate, for rules that rewrite links
+	publicURL string
+}
+
+func presetRules(upstreams presetUpstreams) []response_cache.CacheRule {
+	upstreams.publicURL = strings.TrimSuffix(upstreams.publicURL, "/")
+
+	var rules []response_cache.CacheRule
+	if upstreams.gitPacks != "" {
+		rules = append(rules, gitPackRule(upstreams.gitPacks, upstreams.maxGitRequestSize))
+	}
+	if upstreams.debPools != "" {
+		rules = append(rules, debPoolRule(upstreams.debPools))
+	}
+	if upstreams.rpmRepos != "" {
+		rules = append(rules, rpmRepoRule(upstreams.rpmRepos))
+	}
+	if upstreams.apkRepos != "" {
+		rules = append(rules, apkRepoRules(upstreams.apkRepos, upstreams.apkIndexTTL)...)
+	}
+	if upstreams.goModules != "" {
+		rules = append(rules, goModuleRules(upstreams.goModules, upstreams.goModuleListTTL)...)
+	}
+	if upstreams.npmRegistries != "" {
+		rules = append(rules, npmRegistryRules(upstreams.npmRegistries, upstreams.npmMetadataTTL, upstreams.publicURL)...)
+	}
+	if upstreams.pypiIndexes != "" || upstreams.pypiFiles != "" {
+		rules = append(rules, pypiRules(upstreams.pypiIndexes, upstreams.pypiFiles, upstreams.pypiIndexTTL, upstreams.publicURL)...)
+	}
+	if upstreams.ociRegistries != "" {
+		rules = append(rules, ociRegistryRules(upstreams.ociRegistries, upstreams.ociTagTTL)...)
+	}
+	if upstreams.mavenRepos != "" {
+		rules = append(rules, mavenRepoRules(upstreams.mavenRepos, upstreams.mavenMetadataTTL, upstreams.verifyMavenChecksums)...)
+	}
+	return rules
+}
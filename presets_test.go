@@ -0,0 +1,189 @@
+package main
+
+import "testing"
+
+import "crypto/sha256"
+import "encoding/hex"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "github.com/willbryant/proximate/response_cache"
+import "sync/atomic"
+import "time"
+
+// testPresetServer returns a proxy caching the presets, which sends requests for any of the
+// upstream servers to the given test server.
+func testPresetServer(t *testing.T, upstream *httptest.Server, upstreams presetUpstreams) proximateServer {
+	dir, err := ioutil.TempDir("", "proximate-presets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	rules, err := response_cache.CompileCacheRules(presetRules(upstreams))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ProximateServer(nil, nil, nil, dir, response_cache.DiskCacheOptions{}, rules, nil, nil, 0, true)
+	server.Proxy.Transport = upstream.Client().Transport
+	return server
+}
+
+func TestOCIBlobsCachedWithCredentials(t *testing.T) {
+	blob := "Test blob contents."
+	sum := sha256.Sum256([]byte(blob))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	otherSum := sha256.Sum256([]byte("Some other contents."))
+	otherDigest := "sha256:" + hex.EncodeToString(otherSum[:])
+
+	var requests int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.Header.Get("Authorization") != "Bearer anonymous-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// serve the same contents for both digests, so only one of them matches
+		w.Write([]byte(blob))
+	}))
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+	server := testPresetServer(t, upstream, presetUpstreams{ociRegistries: host})
+
+	get := func(digest string, authorization string) string {
+		req := httptest.NewRequest("GET", "/"+host+"/v2/library/alpine/blobs/"+digest, nil)
+		req.Header.Set("Authorization", authorization)
+		rw := httptest.NewRecorder()
+		server.ServeHTTP(rw, req)
+		return rw.Body.String()
+	}
+
+	for _, authorization := range []string{"Bearer anonymous-token", "Bearer anonymous-token", "Bearer other-token"} {
+		if body := get(digest, authorization); body != blob {
+			t.Errorf("expected the blob, got %q", body)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the blob to be fetched once and then served from the cache whatever the credentials, got %d requests", requests)
+	}
+
+	// blobs that don't match their digest aren't cached
+	requests = 0
+	get(otherDigest, "Bearer anonymous-token")
+	get(otherDigest, "Bearer anonymous-token")
+	if requests != 2 {
+		t.Errorf("expected a blob that doesn't match its digest to be fetched each time, got %d requests", requests)
+	}
+}
+
+type presetPathCase struct {
+	url  string
+	rule string // the name of the rule that should match, or "" if none should
+	ttl  time.Duration
+}
+
+func assertPresetPaths(t *testing.T, upstreams presetUpstreams, cases []presetPathCase) {
+	rules, err := response_cache.CompileCacheRules(presetRules(upstreams))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		rule := rules.Match(httptest.NewRequest("GET", c.url, nil))
+		if rule == nil {
+			if c.rule != "" {
+				t.Errorf("expected %s to match %s, but it didn't match any rule", c.url, c.rule)
+			}
+		} else if rule.Name != c.rule {
+			t.Errorf("expected %s to match %q, but it matched %s", c.url, c.rule, rule.Name)
+		} else if rule.TTL.Duration != c.ttl {
+			t.Errorf("expected %s to be cached for %s, but it's cached for %s", c.url, c.ttl, rule.TTL.Duration)
+		}
+	}
+}
+
+func TestGoModulePresetPaths(t *testing.T) {
+	assertPresetPaths(t, presetUpstreams{goModules: "proxy.golang.org", goModuleListTTL: time.Minute}, []presetPathCase{
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/v0.9.1.zip", "go-modules", 0},
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/v0.9.1.mod", "go-modules", 0},
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/v0.9.1.info", "go-modules", 0},
+		{"https://proxy.golang.org/golang.org/x/net/@v/v0.0.0-20191109021931-daa7c04131f5.info", "go-modules", 0},
+		{"https://proxy.golang.org/github.com/!azure/go-autorest/@v/v14.2.0+incompatible.mod", "go-modules", 0},
+		{"https://proxy.golang.org/github.com/example/module/@v/v1.0.0-!r!c.1.zip", "go-modules", 0},
+
+		// branches, commits, and non-canonical versions may resolve to a different version later
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/master.info", "go-module-lists", time.Minute},
+		{"https://proxy.golang.org/golang.org/x/net/@v/daa7c04131f5.info", "go-module-lists", time.Minute},
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/v0.9.info", "go-module-lists", time.Minute},
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/v00.9.1.info", "go-module-lists", time.Minute},
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/list", "go-module-lists", time.Minute},
+		{"https://proxy.golang.org/github.com/pkg/errors/@latest", "go-module-lists", time.Minute},
+
+		// the go command only downloads canonical versions, so these shouldn't be requested
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/master.zip", "", 0},
+		{"https://proxy.golang.org/github.com/pkg/errors/@v/master.mod", "", 0},
+
+		{"https://proxy.golang.org/sumdb/sum.golang.org/lookup/github.com/pkg/errors@v0.9.1", "", 0},
+		{"https://example.com/github.com/pkg/errors/@v/v0.9.1.zip", "", 0},
+	})
+}
+
+func TestPresetPaths(t *testing.T) {
+	assertPresetPaths(t, presetUpstreams{
+		debPools:      "deb.debian.org",
+		rpmRepos:      "dl.fedoraproject.org",
+		apkRepos:      "dl-cdn.alpinelinux.org",
+		pypiIndexes:   "pypi.org",
+		pypiFiles:     "files.pythonhosted.org",
+		ociRegistries: "registry-1.docker.io",
+		mavenRepos:    "repo.maven.apache.org",
+
+		apkIndexTTL:      time.Minute,
+		pypiIndexTTL:     2 * time.Minute,
+		ociTagTTL:        3 * time.Minute,
+		mavenMetadataTTL: 4 * time.Minute,
+	}, []presetPathCase{
+		{"http://deb.debian.org/debian/pool/main/c/curl/curl_7.88.1-10_amd64.deb", "deb-pools", 0},
+		{"http://deb.debian.org/debian/dists/bookworm/InRelease", "", 0},
+
+		// repomd.xml names the current repodata files, so it must always be fetched
+		{"https://dl.fedoraproject.org/pub/fedora/linux/releases/39/Everything/x86_64/os/Packages/c/curl-8.2.1-3.fc39.x86_64.rpm", "rpm-repos", 0},
+		{"https://dl.fedoraproject.org/pub/fedora/linux/releases/39/Everything/x86_64/os/repodata/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef-primary.xml.zst", "rpm-repos", 0},
+		{"https://dl.fedoraproject.org/pub/fedora/linux/releases/39/Everything/x86_64/os/repodata/repomd.xml", "", 0},
+		{"https://dl.fedoraproject.org/pub/fedora/linux/releases/39/Everything/x86_64/os/repodata/repomd.xml.asc", "", 0},
+
+		{"https://dl-cdn.alpinelinux.org/alpine/v3.19/main/x86_64/curl-8.5.0-r0.apk", "apk-repos", 0},
+		{"https://dl-cdn.alpinelinux.org/alpine/v3.19/main/x86_64/APKINDEX.tar.gz", "apk-indexes", time.Minute},
+
+		{"https://pypi.org/simple/requests/", "pypi-indexes", 2 * time.Minute},
+		{"https://pypi.org/pypi/requests/json", "pypi-indexes", 2 * time.Minute},
+		{"https://pypi.org/pypi/requests/2.31.0/json", "pypi-indexes", 2 * time.Minute},
+		{"https://pypi.org/project/simple/", "", 0},
+		{"https://pypi.org/pypi/requests/json/extra", "", 0},
+		{"https://files.pythonhosted.org/packages/70/8e/0e2d847013cb52cd35b38c009bb167a1a26b2ce6cd6965bf26b47bc0bf44/requests-2.31.0-py3-none-any.whl", "pypi-files", 0},
+		{"https://files.pythonhosted.org/packages/70/8e/", "", 0},
+		{"https://files.pythonhosted.org/simple/requests/", "", 0},
+
+		{"https://registry-1.docker.io/v2/library/alpine/blobs/sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "oci-blobs", 0},
+		{"https://registry-1.docker.io/v2/library/alpine/manifests/sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "oci-manifests", 0},
+		{"https://registry-1.docker.io/v2/library/alpine/manifests/3.19", "oci-tags", 3 * time.Minute},
+		{"https://registry-1.docker.io/v2/library/alpine/blobs/uploads/", "", 0},
+
+		// release artifacts and their checksums never change, but metadata and snapshots do
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9.jar", "maven-artifacts", 0},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9.pom", "maven-artifacts", 0},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9.module", "maven-artifacts", 0},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9.jar.sha1", "maven-checksums", 0},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9.pom.md5", "maven-checksums", 0},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9.jar.sha256", "maven-checksums", 0},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/maven-metadata.xml", "maven-metadata", 4 * time.Minute},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/1.0-SNAPSHOT/maven-metadata.xml", "maven-metadata", 4 * time.Minute},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/1.0-SNAPSHOT/slf4j-api-1.0-SNAPSHOT.jar", "maven-metadata", 4 * time.Minute},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/1.0-SNAPSHOT/slf4j-api-1.0-SNAPSHOT.jar.sha1", "maven-metadata", 4 * time.Minute},
+		{"https://repo.maven.apache.org/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9-sources.zip", "", 0},
+
+		// the rules only apply to their own servers
+		{"https://example.com/debian/pool/main/c/curl/curl_7.88.1-10_amd64.deb", "", 0},
+		{"https://example.com/maven2/org/slf4j/slf4j-api/2.0.9/slf4j-api-2.0.9.jar", "", 0},
+	})
+}
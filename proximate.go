@@ -1,7 +1,9 @@
 package main
 
+import "crypto/tls"
 import "flag"
 import "fmt"
+import "github.com/willbryant/proximate/response_cache"
 import "net"
 import "net/http"
 import "os"
@@ -32,15 +34,52 @@ func default_cache_directory() string {
 }
 
 func main() {
-	var cacheDirectory, cacheGitPackServers, cacheDebPoolServers, listenAddress, port string
-	var healthCheckPath, healthyIfFile, healthyUnlessFile string
-	var quiet bool
+	var cacheDirectory, maxCacheSize, minFreeSpace, checksumAlgorithm, cacheGitPackServers, maxGitRequestSize, cacheDebPoolServers, cacheRpmRepoServers, cacheApkRepoServers, cacheGoModuleServers, cacheNPMRegistryServers, cachePyPIIndexServers, cachePyPIFileServers, cacheOCIRegistryServers, cacheMavenRepoServers, publicURL, listenAddress, port, plainPort string
+	var cacheRulesFile, allowConnect, interceptCACert, interceptCAKey, tlsCert, tlsKey, tlsClientCA, healthCheckPath, healthyIfFile, healthyUnlessFile string
+	var resumeRetries, abandonFillsUnder int
+	var minFreeInodes uint64
+	var cacheScanInterval, apkIndexTTL, goModuleListTTL, npmMetadataTTL, pypiIndexTTL, ociTagTTL, mavenMetadataTTL time.Duration
+	var verifyChecksums, verifyMavenChecksums, offlineResilience, quiet bool
 
 	flag.StringVar(&cacheDirectory, "data", default_cache_directory(), "Sets the root data directory to /foo.  Must be fully-qualified (ie. it must start with a /).")
+	flag.StringVar(&maxCacheSize, "max-cache-size", "", "Evict the least recently used cache entries once the cache grows past this size.  May use K, M, G, or T suffixes (eg. \"50G\").  Default: no limit.")
+	flag.StringVar(&minFreeSpace, "min-free-space", "", "Stop caching new responses (but keep proxying them) while the cache filesystem has less than this much free space.  May use K, M, G, or T suffixes (eg. \"5G\").  Default: no minimum.")
+	flag.Uint64Var(&minFreeInodes, "min-free-inodes", 0, "Stop caching new responses (but keep proxying them) while the cache filesystem has fewer than this many free inodes.  Default: no minimum.")
+	flag.DurationVar(&cacheScanInterval, "cache-scan-interval", 0, "Rescan the cache directory for leftover temporary files and corrupt entries this often (eg. \"24h\").  The cache directory is always scanned on startup.  Default: only scan on startup.")
+	flag.IntVar(&abandonFillsUnder, "abandon-fills-under", 0, "If every client waiting for a response that's being cached disconnects before it's this percent complete, stop fetching it.  Responses of unknown length are always abandoned.  Default: always finish fetching the response.")
+	flag.StringVar(&checksumAlgorithm, "cache-checksum", "sha256", "Store a checksum of each response body in the cache using this algorithm (sha1, sha256, sha512, or none).")
+	flag.BoolVar(&verifyChecksums, "verify-cache-checksums", false, "Verify the checksum of cached responses before serving them, and fetch them again if they don't match.  This means reading each response twice.")
 	flag.StringVar(&cacheGitPackServers, "cache-git-packs", "", "Cache git pack requests from this comma-separated list of servers.  May include paths (eg. \"github.com/willbryant,github.com/rails,gitlab.com\").")
+	flag.StringVar(&maxGitRequestSize, "max-git-request-size", DefaultMaxGitRequestSize, "Proxy git pack requests larger than this without caching them, rather than reading them into a temporary file to work out if they can be cached.  May use K, M, G, or T suffixes.")
 	flag.StringVar(&cacheDebPoolServers, "cache-deb-pools", "", "Cache deb pool requests from this comma-separated list of servers.  May include paths (eg. \"security.ubuntu.com,somemirrors.org/ubuntu\").")
+	flag.StringVar(&cacheRpmRepoServers, "cache-rpm-repos", "", "Cache rpm package and repodata requests from this comma-separated list of servers.  May include paths (eg. \"dl.rockylinux.org/pub/rocky,*.fedoraproject.org\").  repomd.xml is always fetched from the server.")
+	flag.StringVar(&cacheApkRepoServers, "cache-apk-repos", "", "Cache Alpine apk package and index requests from this comma-separated list of servers.  May include paths (eg. \"dl-cdn.alpinelinux.org/alpine/\").")
+	flag.DurationVar(&apkIndexTTL, "apk-index-ttl", DefaultAPKIndexTTL*time.Second, "Revalidate cached APKINDEX.tar.gz files with the server once they're this old, fetching them again if they've changed.")
+	flag.StringVar(&cacheGoModuleServers, "cache-go-modules", "", "Cache Go module downloads from this comma-separated list of module proxies (eg. \"proxy.golang.org\").  Point GOPROXY at the proxy through proximate (eg. GOPROXY=http://proximate:8080/proxy.golang.org).  sumdb requests are always proxied.")
+	flag.DurationVar(&goModuleListTTL, "go-module-list-ttl", DefaultGoModuleListTTL*time.Second, "Fetch cached Go module version lists and queries (@v/list, @latest, and .info requests for branches or commits) again once they're this old.")
+	flag.StringVar(&cacheNPMRegistryServers, "cache-npm-registries", "", "Cache npm package tarball and document requests from this comma-separated list of registries (eg. \"registry.npmjs.org\").  Point npm at the registry through proximate (eg. registry=http://proximate:8080/registry.npmjs.org/).")
+	flag.DurationVar(&npmMetadataTTL, "npm-metadata-ttl", DefaultNPMMetadataTTL*time.Second, "Revalidate cached npm package documents once they're this old.")
+	flag.StringVar(&cachePyPIIndexServers, "cache-pypi-indexes", "", "Cache PyPI simple index pages and JSON API requests from this comma-separated list of servers (eg. \"pypi.org\").  Point pip at the index through proximate (eg. --index-url http://proximate:8080/pypi.org/simple/).")
+	flag.StringVar(&cachePyPIFileServers, "cache-pypi-files", "", "Cache PyPI package file requests from this comma-separated list of servers (eg. \"files.pythonhosted.org\").")
+	flag.DurationVar(&pypiIndexTTL, "pypi-index-ttl", DefaultPyPIIndexTTL*time.Second, "Revalidate cached PyPI index pages once they're this old.")
+	flag.StringVar(&cacheOCIRegistryServers, "cache-oci-registries", "", "Cache container image layers and manifests from this comma-separated list of OCI/Docker registries (eg. \"registry-1.docker.io,ghcr.io\").  Point your container runtime's registry mirror at the registry through proximate (eg. http://proximate:8080/registry-1.docker.io).  Cached responses are shared without checking credentials, so only list registries whose images every client may pull.")
+	flag.DurationVar(&ociTagTTL, "oci-tag-ttl", DefaultOCITagTTL*time.Second, "Revalidate cached image tag lookups once they're this old.")
+	flag.StringVar(&cacheMavenRepoServers, "cache-maven-repos", "", "Cache Maven and Gradle artifact requests from this comma-separated list of repositories.  May include paths (eg. \"repo.maven.apache.org/maven2/,plugins.gradle.org/m2/\").")
+	flag.DurationVar(&mavenMetadataTTL, "maven-metadata-ttl", DefaultMavenMetadataTTL*time.Second, "Revalidate cached maven-metadata.xml files and snapshot artifacts once they're this old.")
+	flag.BoolVar(&verifyMavenChecksums, "verify-maven-checksums", false, "Check each Maven artifact against the .sha1 file that the repository publishes alongside it, and don't cache it if it doesn't match.")
+	flag.BoolVar(&offlineResilience, "offline-resilience", false, "If a cached response has expired but fetching it again fails, serve the expired response with a Warning header instead of an error.")
+	flag.IntVar(&resumeRetries, "resume-retries", 3, "If the upstream connection drops while a response is being cached, try this many times to fetch the rest with a range request.  Only possible if the upstream server supports ranges.  0 to disable.")
+	flag.StringVar(&cacheRulesFile, "cache-rules", "", "Cache requests matching the rules in this TOML file, which are tried in order before the lists above.  See CacheRule in response_cache/cache_rules.go for the settings.")
+	flag.StringVar(&publicURL, "public-url", "", "The URL that clients use to reach proximate (eg. \"http://proximate:8080\").  If given, the package links in cached npm package documents and PyPI index pages are rewritten to go through proximate.  Default: leave the links pointing at the upstream servers.")
+	flag.StringVar(&allowConnect, "allow-connect", "", "Let clients open tunnels with CONNECT requests (eg. for https_proxy) to this comma-separated list of host:port patterns (eg. \"*.github.com:443,example.com\").  Hosts may use * wildcards, and the port defaults to 443.  Tunnelled traffic isn't cached unless intercept-ca-cert is given.  Default: refuse CONNECT requests.")
+	flag.StringVar(&interceptCACert, "intercept-ca-cert", "", "Intercept CONNECT tunnels to the servers listed in the cache options above, so that their requests can be cached, by terminating TLS using certificates signed by the CA certificate in this PEM file.  Clients must trust this CA.  Tunnels to these servers are allowed even if they aren't listed in allow-connect.  Default: don't intercept tunnels.")
+	flag.StringVar(&interceptCAKey, "intercept-ca-key", "", "The PEM file containing the private key for intercept-ca-cert.")
 	flag.StringVar(&listenAddress, "listen", DefaultListenAddress, "Listen on the given IP address.  Default: listen on all network interfaces.")
 	flag.StringVar(&port, "port", DefaultPort, "Listen on the given port.")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Serve requests on the port over TLS using the certificate in this PEM file.  The certificate is reloaded automatically when this file or tls-key changes (eg. when renewed by certbot).  Default: serve plain HTTP.")
+	flag.StringVar(&tlsKey, "tls-key", "", "The PEM file containing the private key for tls-cert.")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "Require clients connecting over TLS to present a certificate signed by one of the CAs in this PEM file.  Default: don't ask for client certificates.")
+	flag.StringVar(&plainPort, "http-port", "", "Also serve plain HTTP requests on this port when using tls-cert.  Default: only serve TLS.")
 	flag.BoolVar(&quiet, "quiet", false, "Quiet mode.  Don't print startup/shutdown/request log messages to stdout.")
 	flag.StringVar(&healthCheckPath, "health-check-path", "", "Treat requests to this path as health checks from your load balancer, and give a 200 response without trying to serve a file.")
 	flag.StringVar(&healthyIfFile, "healthy-if-file", "", "Respond to requests to the health-check-path with a 503 response code if this file doesn't exist.")
@@ -50,20 +89,132 @@ func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	maxCacheBytes, err := ParseByteSize(maxCacheSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid max-cache-size: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	minFreeBytes, err := ParseByteSize(minFreeSpace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid min-free-space: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	maxGitRequestBytes, err := ParseByteSize(maxGitRequestSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid max-git-request-size: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if checksumAlgorithm == "none" {
+		checksumAlgorithm = ""
+	}
+	if !response_cache.ChecksumAlgorithmSupported(checksumAlgorithm) {
+		fmt.Fprintf(os.Stderr, "Invalid cache-checksum: %s\n", checksumAlgorithm)
+		os.Exit(1)
+	}
+
+	cacheOptions := response_cache.DiskCacheOptions{
+		MaxSize:           maxCacheBytes,
+		MinFreeBytes:      uint64(minFreeBytes),
+		MinFreeInodes:     minFreeInodes,
+		ScanInterval:      cacheScanInterval,
+		AbandonFillsUnder: abandonFillsUnder,
+		ServeStaleOnError: offlineResilience,
+		ChecksumAlgorithm: checksumAlgorithm,
+		VerifyChecksums:   verifyChecksums,
+	}
+
+	rules := presetRules(presetUpstreams{
+		gitPacks:      cacheGitPackServers,
+		debPools:      cacheDebPoolServers,
+		rpmRepos:      cacheRpmRepoServers,
+		apkRepos:      cacheApkRepoServers,
+		goModules:     cacheGoModuleServers,
+		npmRegistries: cacheNPMRegistryServers,
+		pypiIndexes:   cachePyPIIndexServers,
+		pypiFiles:     cachePyPIFileServers,
+		ociRegistries: cacheOCIRegistryServers,
+		mavenRepos:    cacheMavenRepoServers,
+
+		maxGitRequestSize: maxGitRequestBytes,
+
+		apkIndexTTL:      apkIndexTTL,
+		goModuleListTTL:  goModuleListTTL,
+		npmMetadataTTL:   npmMetadataTTL,
+		pypiIndexTTL:     pypiIndexTTL,
+		ociTagTTL:        ociTagTTL,
+		mavenMetadataTTL: mavenMetadataTTL,
+
+		verifyMavenChecksums: verifyMavenChecksums,
+
+		publicURL: publicURL,
+	})
+	if cacheRulesFile != "" {
+		fileRules, err := response_cache.LoadCacheRules(cacheRulesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't load cache-rules file %s: %s\n", cacheRulesFile, err.Error())
+			os.Exit(1)
+		}
+		// rules from the file come first so they can override the built-in rules
+		rules = append(fileRules, rules...)
+	}
+	cacheRules, err := response_cache.CompileCacheRules(rules)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid cache rules: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	var interceptor *CertificateAuthority
+	if interceptCACert != "" || interceptCAKey != "" {
+		interceptor, err = LoadCertificateAuthority(interceptCACert, interceptCAKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't load intercept-ca-cert and intercept-ca-key: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	scheme := "http"
+	if tlsCert != "" || tlsKey != "" {
+		tlsConfig, err = ServerTLSConfig(tlsCert, tlsKey, tlsClientCA, quiet)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't load tls-cert and tls-key: %s\n", err.Error())
+			os.Exit(1)
+		}
+		scheme = "https"
+	} else if tlsClientCA != "" || plainPort != "" {
+		fmt.Fprintf(os.Stderr, "tls-client-ca and http-port can only be used with tls-cert\n")
+		os.Exit(1)
+	}
+
 	listener, err := net.Listen("tcp", listenAddress+":"+port)
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't listen on %s:%s: %s\n", listenAddress, port, err.Error())
 		os.Exit(1)
 	} else if !quiet {
-		fmt.Fprintf(os.Stdout, "%s listening on http://%s:%s, cache in %s\n", banner(), listenAddress, port, cacheDirectory)
+		fmt.Fprintf(os.Stdout, "%s listening on %s://%s:%s, cache in %s\n", banner(), scheme, listenAddress, port, cacheDirectory)
+	}
+
+	var plainListener net.Listener
+	if plainPort != "" {
+		plainListener, err = net.Listen("tcp", listenAddress+":"+plainPort)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't listen on %s:%s: %s\n", listenAddress, plainPort, err.Error())
+			os.Exit(1)
+		} else if !quiet {
+			fmt.Fprintf(os.Stdout, "%s listening on http://%s:%s\n", banner(), listenAddress, plainPort)
+		}
 	}
 
-	server := ProximateServer(listener, cacheDirectory, cacheGitPackServers, cacheDebPoolServers, quiet)
+	server := ProximateServer(listener, tlsConfig, plainListener, cacheDirectory, cacheOptions, cacheRules, NewTunnelAllowlist(allowConnect), interceptor, resumeRetries, quiet)
 	go waitForSignals(&server)
 
 	if healthCheckPath != "" {
-		http.Handle(AddRoot(healthCheckPath), HealthCheckServer(healthyIfFile, healthyUnlessFile))
+		http.Handle(AddRoot(healthCheckPath), HealthCheckServer(healthyIfFile, healthyUnlessFile, server.Cache))
 	}
 	http.Handle("/", server)
 
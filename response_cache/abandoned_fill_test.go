@@ -0,0 +1,133 @@
+package response_cache
+
+import "testing"
+
+import "context"
+import "io"
+import "net/http"
+import "time"
+
+// starts a fill from a response whose body is written to the returned pipe, reads the first part
+// of the body, and disconnects
+func startAndDisconnect(t *testing.T, cache ResponseCache, body string, contentLength int64, read int) *io.PipeWriter {
+	reader, writer := io.Pipe()
+	go writer.Write([]byte(body[:read]))
+
+	res, err := cache.Get("aaaa", func() (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{},
+			ContentLength: contentLength,
+			Body:          reader,
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(res.Body, make([]byte, read)); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return writer
+}
+
+func waitForFillToFinish(cache ResponseCache, path string) {
+	for cache.(*diskCache).fillInProgress(path) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAbandonsFillsNobodyIsWaitingFor(t *testing.T) {
+	cache.Clear()
+	abandoningCache := NewDiskCache("test/cache", DiskCacheOptions{AbandonFillsUnder: 50})
+
+	body := "Test response body that nobody waits for."
+	writer := startAndDisconnect(t, abandoningCache, body, int64(len(body)), 10)
+
+	// the upstream response should be closed, rather than read to the end
+	waitForFillToFinish(abandoningCache, "test/cache/aaaa")
+	if _, err := writer.Write([]byte(body[10:])); err != io.ErrClosedPipe {
+		t.Errorf("expected the upstream response to be closed, got %v", err)
+	}
+	assertCached(t, "test/cache/aaaa", false)
+}
+
+func TestDoesNotResumeAbandonedFills(t *testing.T) {
+	cache.Clear()
+	abandoningCache := NewDiskCache("test/cache", DiskCacheOptions{AbandonFillsUnder: 50})
+
+	body := "Test response body that nobody waits for."
+	reader, writer := io.Pipe()
+	go writer.Write([]byte(body[:10]))
+	resumed := make(chan http.Header, 1)
+
+	res, err := abandoningCache.Get("aaaa", func() (*http.Response, error) {
+		res := resumableResponse(body, 10)
+		res.Body = reader
+		return ResumeInterruptedBody(context.Background(), res, 3, func(rangeHeaders http.Header) (*http.Response, error) {
+			resumed <- rangeHeaders
+			return partialResponse(body, 10, len(body), "bytes 10-40/41"), nil
+		}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(res.Body, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// closing the upstream response makes the read fail, but that's not an interruption to resume
+	waitForFillToFinish(abandoningCache, "test/cache/aaaa")
+	select {
+	case rangeHeaders := <-resumed:
+		t.Errorf("expected the abandoned fill not to be resumed, but it was resumed with %s", rangeHeaders.Get("Range"))
+	default:
+	}
+	assertCached(t, "test/cache/aaaa", false)
+}
+
+func TestAbandonsFillsOfUnknownLength(t *testing.T) {
+	cache.Clear()
+	abandoningCache := NewDiskCache("test/cache", DiskCacheOptions{AbandonFillsUnder: 50})
+
+	body := "Test response body that nobody waits for."
+	writer := startAndDisconnect(t, abandoningCache, body, -1, 30)
+
+	waitForFillToFinish(abandoningCache, "test/cache/aaaa")
+	if _, err := writer.Write([]byte(body[30:])); err != io.ErrClosedPipe {
+		t.Errorf("expected the upstream response to be closed, got %v", err)
+	}
+	assertCached(t, "test/cache/aaaa", false)
+}
+
+func TestFinishesFillsPastThreshold(t *testing.T) {
+	cache.Clear()
+	abandoningCache := NewDiskCache("test/cache", DiskCacheOptions{AbandonFillsUnder: 50})
+
+	body := "Test response body that nobody waits for."
+	writer := startAndDisconnect(t, abandoningCache, body, int64(len(body)), 30)
+
+	if _, err := writer.Write([]byte(body[30:])); err != nil {
+		t.Errorf("expected the rest of the response to be read, got %v", err)
+	}
+	writer.Close()
+
+	waitForFillToFinish(abandoningCache, "test/cache/aaaa")
+	assertCached(t, "test/cache/aaaa", true)
+}
+
+func TestFinishesFillsByDefault(t *testing.T) {
+	cache.Clear()
+
+	body := "Test response body that nobody waits for."
+	writer := startAndDisconnect(t, cache, body, int64(len(body)), 10)
+
+	if _, err := writer.Write([]byte(body[10:])); err != nil {
+		t.Errorf("expected the rest of the response to be read, got %v", err)
+	}
+	writer.Close()
+
+	waitForFillToFinish(cache, "test/cache/aaaa")
+	assertCached(t, "test/cache/aaaa", true)
+}
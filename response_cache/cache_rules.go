@@ -0,0 +1,262 @@
+package response_cache
+
+import "errors"
+import "fmt"
+import "net/http"
+import "path"
+import "regexp"
+import "strings"
+import "time"
+import "github.com/BurntSushi/toml"
+
+// CacheRule describes a class of requests whose responses we cache.  a request must meet all of
+// the conditions given to match the rule.  in a rules file, each rule is a [[rule]] table with the
+// settings named in the toml tags below, and rules are tried in the order they're listed, eg.
+//
+//	[[rule]]
+//	name = "downloads"
+//	hosts = ["downloads.example.com/releases/"]
+//	path_regexp = '\.tar\.gz$'
+//	forbidden_headers = ["Authorization"]
+//	key_headers = []
+//	ttl = "24h"
+type CacheRule struct {
+	// identifies the rule in errors
+	Name string `toml:"name"`
+
+	// the request methods to match; empty means GET and HEAD
+	Methods []string `toml:"methods"`
+
+	// the servers to match, in the same format as the upstream lists: host names, optionally with
+	// * wildcards and followed by a path prefix (eg. "*.archive.ubuntu.com/ubuntu/"); empty means
+	// any server
+	Hosts []string `toml:"hosts"`
+
+	// a path.Match pattern and/or regular expression that the request path must match
+	PathGlob   string `toml:"path_glob"`
+	PathRegexp string `toml:"path_regexp"`
+
+	// headers that must have the given value ("*" means any value), and headers that must not be
+	// present
+	RequiredHeaders  map[string]string `toml:"required_headers"`
+	ForbiddenHeaders []string          `toml:"forbidden_headers"`
+
+	// fetch responses again once they've been cached for this long (eg. "10m"); 0 means never
+	TTL Duration `toml:"ttl"`
+
+	// don't cache responses larger than this many bytes, or responses that don't say how large
+	// they are; 0 means no limit
+	MaxBodySize int64 `toml:"max_body_size"`
+
+	// don't cache requests whose bodies are larger than this many bytes, but proxy them as they
+	// are; 0 means DefaultMaxRequestBodySize
+	MaxRequestBodySize int64 `toml:"max_request_body_size"`
+
+	// the request headers to include in the cache key; not given means all of them, and an empty
+	// list means none of them
+	KeyHeaders []string `toml:"key_headers"`
+
+	// include the HTTP version of the request in the cache key
+	KeyProto bool `toml:"key_proto"`
+
+	// query parameters to leave out of the cache key, such as tracking parameters
+	KeyIgnoreQuery []string `toml:"key_ignore_query"`
+
+	// follow redirects and cache the response they lead to, rather than the redirect
+	FollowRedirects bool `toml:"follow_redirects"`
+
+	// Match is an extra condition for built-in rules that can't be expressed using the fields above
+	Match func(req *http.Request) bool `toml:"-"`
+
+	// KeyFunction optionally replaces the usual cache key, for built-in rules whose responses are
+	// identified by something in the request, like a content digest
+	KeyFunction func(req *http.Request) string `toml:"-"`
+
+	// Rewrite optionally changes or checks successful responses before they're cached, for built-in
+	// rules.  requests for rules that rewrite responses are sent without Accept-Encoding, so that
+	// the body isn't compressed.  fetch sends other requests upstream as part of the same fill.
+	Rewrite func(req *http.Request, res *http.Response, fetch func(req *http.Request) (*http.Response, error)) `toml:"-"`
+
+	upstreams  *Upstreams
+	pathRegexp *regexp.Regexp
+}
+
+// Duration is a time.Duration that is written as a string like "10m" in the rules file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type CacheRules []*CacheRule
+
+type cacheRulesFile struct {
+	Rules []CacheRule `toml:"rule"`
+}
+
+// LoadCacheRules reads a list of rules from a TOML file, in which each rule is a [[rule]] table.
+func LoadCacheRules(filename string) ([]CacheRule, error) {
+	var file cacheRulesFile
+	metadata, err := toml.DecodeFile(filename, &file)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown setting %s", undecoded[0])
+	}
+	return file.Rules, nil
+}
+
+// CompileCacheRules checks the rules and prepares them for matching.  requests are matched against
+// the rules in order.
+func CompileCacheRules(rules []CacheRule) (CacheRules, error) {
+	var result CacheRules
+	for index := range rules {
+		rule := rules[index]
+		if err := rule.compile(); err != nil {
+			if rule.Name != "" {
+				return nil, fmt.Errorf("rule %s: %s", rule.Name, err)
+			}
+			return nil, fmt.Errorf("rule %d: %s", index+1, err)
+		}
+		result = append(result, &rule)
+	}
+	return result, nil
+}
+
+func (rule *CacheRule) compile() (err error) {
+	if len(rule.Methods) == 0 {
+		rule.Methods = []string{"GET", "HEAD"}
+	}
+	for index, method := range rule.Methods {
+		rule.Methods[index] = strings.ToUpper(method)
+	}
+
+	if len(rule.Hosts) > 0 {
+		rule.upstreams = NewUpstreams(strings.Join(rule.Hosts, ","))
+	}
+
+	if rule.PathGlob != "" {
+		if _, err := path.Match(rule.PathGlob, ""); err != nil {
+			return errors.New("invalid path_glob: " + err.Error())
+		}
+	}
+
+	if rule.PathRegexp != "" {
+		rule.pathRegexp, err = regexp.Compile(rule.PathRegexp)
+		if err != nil {
+			return errors.New("invalid path_regexp: " + err.Error())
+		}
+	}
+
+	if rule.TTL.Duration < 0 || rule.MaxBodySize < 0 || rule.MaxRequestBodySize < 0 {
+		return errors.New("ttl, max_body_size, and max_request_body_size must not be negative")
+	}
+	if rule.MaxRequestBodySize == 0 {
+		rule.MaxRequestBodySize = DefaultMaxRequestBodySize
+	}
+	return nil
+}
+
+// Matches returns true if the request meets all of the rule's conditions.
+func (rule *CacheRule) Matches(req *http.Request) bool {
+	if !rule.methodListed(req.Method) {
+		return false
+	}
+
+	if rule.upstreams != nil && !rule.upstreams.UpstreamListed(req.URL) {
+		return false
+	}
+
+	if rule.PathGlob != "" {
+		if matched, _ := path.Match(rule.PathGlob, req.URL.Path); !matched {
+			return false
+		}
+	}
+
+	if rule.pathRegexp != nil && !rule.pathRegexp.MatchString(req.URL.Path) {
+		return false
+	}
+
+	for name, value := range rule.RequiredHeaders {
+		actual := req.Header.Get(name)
+		if actual == "" || (value != "*" && actual != value) {
+			return false
+		}
+	}
+
+	for _, name := range rule.ForbiddenHeaders {
+		if req.Header.Get(name) != "" {
+			return false
+		}
+	}
+
+	// we need to read the body to make the cache key, so if it's too big, just proxy the request
+	if _, err := spoolRequestBody(req, rule.MaxRequestBodySize); err != nil {
+		return false
+	}
+
+	return rule.Match == nil || rule.Match(req)
+}
+
+func (rule *CacheRule) methodListed(method string) bool {
+	for _, listed := range rule.Methods {
+		if listed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the cache key for the request, which includes the parts of the request that the
+// rule's key settings say to.
+func (rule *CacheRule) Key(req *http.Request) (string, error) {
+	if rule.KeyFunction != nil {
+		return rule.KeyFunction(req), nil
+	}
+	return HashRequest(req, KeyOptions{
+		Headers:      rule.KeyHeaders,
+		IncludeProto: rule.KeyProto,
+		IgnoreQuery:  rule.KeyIgnoreQuery,
+	})
+}
+
+// LegacyKey returns the key that the request's response would have been cached under before
+// rules had key settings, or "" if the rule has never used that kind of key.
+func (rule *CacheRule) LegacyKey(req *http.Request) (string, error) {
+	if rule.KeyFunction != nil {
+		return "", nil
+	}
+	return HashRequestAndBody(req)
+}
+
+// CacheableSize returns false if the response says it's larger than the rule allows us to cache,
+// or if the rule has a limit and the response doesn't say how large it is, since we'd have no way
+// to stop it growing past the limit.
+func (rule *CacheRule) CacheableSize(res *http.Response) bool {
+	return rule.MaxBodySize == 0 || (res.ContentLength >= 0 && res.ContentLength <= rule.MaxBodySize)
+}
+
+// Match returns the first rule that matches the request, or nil if none do.
+func (rules CacheRules) Match(req *http.Request) *CacheRule {
+	for _, rule := range rules {
+		if rule.Matches(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// HostListed returns true if any rule lists the server in its hosts.  rules that apply to any
+// server aren't counted.
+func (rules CacheRules) HostListed(host string) bool {
+	for _, rule := range rules {
+		if rule.upstreams != nil && rule.upstreams.HostListed(host) {
+			return true
+		}
+	}
+	return false
+}
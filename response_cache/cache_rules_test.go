@@ -0,0 +1,221 @@
+package response_cache
+
+import "testing"
+
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "strings"
+import "time"
+
+const testCacheRules = `
+[[rule]]
+name = "rpms"
+hosts = ["*.example.com/rocky/"]
+path_glob = "/rocky/*/Packages/*.rpm"
+forbidden_headers = ["Authorization"]
+key_headers = ["Accept"]
+
+[[rule]]
+name = "indexes"
+methods = ["get"]
+path_regexp = '/repodata/repomd\.xml$'
+required_headers = { "Accept" = "*", "X-Client" = "dnf" }
+ttl = "10m"
+max_body_size = 1048576
+`
+
+func writeRulesFile(t *testing.T, rules string) string {
+	file, err := ioutil.TempFile("", "cache_rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(rules)
+	file.Close()
+	return file.Name()
+}
+
+func loadTestRules(t *testing.T, rules string) CacheRules {
+	filename := writeRulesFile(t, rules)
+	defer os.Remove(filename)
+
+	loaded, err := LoadCacheRules(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := CompileCacheRules(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compiled
+}
+
+func requestFor(method string, url string, header map[string]string) *http.Request {
+	req := httptest.NewRequest(method, url, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func assertMatchedRule(t *testing.T, rules CacheRules, req *http.Request, expected string) {
+	rule := rules.Match(req)
+	if expected == "" && rule != nil {
+		t.Errorf("expected %s %s not to match any rule, but it matched %s", req.Method, req.URL, rule.Name)
+	} else if expected != "" && (rule == nil || rule.Name != expected) {
+		t.Errorf("expected %s %s to match rule %s, but it matched %v", req.Method, req.URL, expected, rule)
+	}
+}
+
+func TestLoadCacheRules(t *testing.T) {
+	rules := loadTestRules(t, testCacheRules)
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	if rules[0].TTL.Duration != 0 || rules[1].TTL.Duration != 10*time.Minute || rules[1].MaxBodySize != 1048576 {
+		t.Errorf("expected the rule settings to be loaded, got %v %v", rules[0], rules[1])
+	}
+}
+
+func TestCacheRulesMatch(t *testing.T) {
+	rules := loadTestRules(t, testCacheRules)
+
+	rpm := "http://mirror.example.com/rocky/9/Packages/test.rpm"
+	assertMatchedRule(t, rules, requestFor("GET", rpm, nil), "rpms")
+	assertMatchedRule(t, rules, requestFor("HEAD", rpm, nil), "rpms")
+	assertMatchedRule(t, rules, requestFor("POST", rpm, nil), "")
+	assertMatchedRule(t, rules, requestFor("GET", "http://mirror.example.org/rocky/9/Packages/test.rpm", nil), "")
+	assertMatchedRule(t, rules, requestFor("GET", "http://mirror.example.com/rocky/9/Packages/test.deb", nil), "")
+	assertMatchedRule(t, rules, requestFor("GET", "http://mirror.example.com/rocky/9/Packages/x/test.rpm", nil), "")
+	assertMatchedRule(t, rules, requestFor("GET", rpm, map[string]string{"Authorization": "Basic Zm9vOmJhcg=="}), "")
+
+	repomd := "http://anywhere.example.org/rocky/9/repodata/repomd.xml"
+	assertMatchedRule(t, rules, requestFor("GET", repomd, map[string]string{"Accept": "*/*", "X-Client": "dnf"}), "indexes")
+	assertMatchedRule(t, rules, requestFor("HEAD", repomd, map[string]string{"Accept": "*/*", "X-Client": "dnf"}), "")
+	assertMatchedRule(t, rules, requestFor("GET", repomd, map[string]string{"X-Client": "dnf"}), "")
+	assertMatchedRule(t, rules, requestFor("GET", repomd, map[string]string{"Accept": "*/*", "X-Client": "yum"}), "")
+}
+
+func TestCacheRuleMatchFunction(t *testing.T) {
+	rules, err := CompileCacheRules([]CacheRule{{
+		Name:  "small",
+		Hosts: []string{"example.com"},
+		Match: func(req *http.Request) bool { return req.URL.Query().Get("size") == "small" },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertMatchedRule(t, rules, requestFor("GET", "http://example.com/file?size=small", nil), "small")
+	assertMatchedRule(t, rules, requestFor("GET", "http://example.com/file?size=large", nil), "")
+}
+
+func TestCacheRuleKeys(t *testing.T) {
+	rules := loadTestRules(t, testCacheRules)
+	rpm := "http://mirror.example.com/rocky/9/Packages/test.rpm"
+
+	key, _ := rules[0].Key(requestFor("GET", rpm, map[string]string{"Accept": "*/*", "User-Agent": "dnf/4"}))
+	otherAgent, _ := rules[0].Key(requestFor("GET", rpm, map[string]string{"Accept": "*/*", "User-Agent": "dnf/5"}))
+	otherAccept, _ := rules[0].Key(requestFor("GET", rpm, map[string]string{"Accept": "text/plain", "User-Agent": "dnf/4"}))
+	if key != otherAgent {
+		t.Error("expected the key not to vary on headers not listed in key_headers")
+	}
+	if key == otherAccept {
+		t.Error("expected the key to vary on headers listed in key_headers")
+	}
+}
+
+func TestCacheRuleKeySettings(t *testing.T) {
+	rules := loadTestRules(t, `
+[[rule]]
+name = "no-headers"
+key_headers = []
+key_ignore_query = ["utm_source"]
+
+[[rule]]
+name = "all-headers"
+key_proto = true
+`)
+	rpm := "http://mirror.example.com/rocky/9/Packages/test.rpm"
+	key, _ := rules[0].Key(requestFor("GET", rpm, map[string]string{"User-Agent": "dnf/4"}))
+	otherAgent, _ := rules[0].Key(requestFor("GET", rpm+"?utm_source=test", map[string]string{"User-Agent": "dnf/5"}))
+	if key != otherAgent {
+		t.Error("expected the key not to vary on headers or ignored query parameters when key_headers is empty")
+	}
+
+	key, _ = rules[1].Key(requestFor("GET", rpm, map[string]string{"User-Agent": "dnf/4"}))
+	otherAgent, _ = rules[1].Key(requestFor("GET", rpm, map[string]string{"User-Agent": "dnf/5"}))
+	if key == otherAgent {
+		t.Error("expected the key to vary on all headers when key_headers is not given")
+	}
+
+	req := requestFor("GET", rpm, map[string]string{"User-Agent": "dnf/4"})
+	legacyKey, _ := rules[1].LegacyKey(req)
+	if expected, _ := HashRequestAndBody(req); legacyKey != expected || legacyKey == key {
+		t.Error("expected the legacy key to be the old request hash")
+	}
+}
+
+func TestCacheRuleMaxBodySize(t *testing.T) {
+	rule := CacheRule{MaxBodySize: 100}
+	for contentLength, expected := range map[int64]bool{-1: false, 0: true, 100: true, 101: false} {
+		if rule.CacheableSize(&http.Response{ContentLength: contentLength}) != expected {
+			t.Errorf("expected CacheableSize to be %v for length %d", expected, contentLength)
+		}
+	}
+
+	unlimited := CacheRule{}
+	if !unlimited.CacheableSize(&http.Response{ContentLength: -1}) {
+		t.Error("expected responses of unknown length to be cacheable when there's no limit")
+	}
+}
+
+func TestCacheRuleMaxRequestBodySize(t *testing.T) {
+	rules, err := CompileCacheRules([]CacheRule{{
+		Name:               "small",
+		Methods:            []string{"POST"},
+		MaxRequestBodySize: 100,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{strings.Repeat("a", 100), strings.Repeat("a", 101), strings.Repeat("a", maxInMemoryBody*2)} {
+		req := requestWithBody(body, -1)
+		expected := ""
+		if len(body) <= 100 {
+			expected = "small"
+		}
+		assertMatchedRule(t, rules, req, expected)
+
+		// whether or not it matched, the whole body should be sent upstream
+		if data, _ := ioutil.ReadAll(req.Body); string(data) != body {
+			t.Errorf("expected the body to be kept, got %d bytes", len(data))
+		}
+		req.Body.Close()
+	}
+
+	if rule := (CacheRule{}); rule.compile() != nil || rule.MaxRequestBodySize != DefaultMaxRequestBodySize {
+		t.Errorf("expected the default request body size limit, got %d", rule.MaxRequestBodySize)
+	}
+}
+
+func TestInvalidCacheRules(t *testing.T) {
+	for _, rules := range []string{
+		"[[rule]]\npath_regexp = '('\n",
+		"[[rule]]\npath_glob = '['\n",
+		"[[rule]]\nttl = 'soon'\n",
+		"[[rule]]\nunknown_setting = 1\n",
+	} {
+		filename := writeRulesFile(t, rules)
+		loaded, err := LoadCacheRules(filename)
+		if err == nil {
+			_, err = CompileCacheRules(loaded)
+		}
+		if err == nil {
+			t.Errorf("expected an error for %q", rules)
+		}
+		os.Remove(filename)
+	}
+}
@@ -0,0 +1,27 @@
+package response_cache
+
+import "crypto/sha1"
+import "crypto/sha256"
+import "crypto/sha512"
+import "hash"
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// ChecksumAlgorithmSupported returns true if the named algorithm can be used to checksum cache
+// entries.  The empty string means no checksum, and is always supported.
+func ChecksumAlgorithmSupported(algorithm string) bool {
+	_, ok := checksumAlgorithms[algorithm]
+	return ok || algorithm == ""
+}
+
+// newChecksum returns a hash for the named algorithm, or nil if no checksum should be calculated.
+func newChecksum(algorithm string) hash.Hash {
+	if newHash, ok := checksumAlgorithms[algorithm]; ok {
+		return newHash()
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package response_cache
+
+import "testing"
+
+import "bytes"
+import "crypto/sha256"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "syscall"
+import "github.com/tinylib/msgp/msgp"
+
+func readEntryHeader(t *testing.T, path string) DiskCacheHeader {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	diskCacheHeader, _, err := decodeHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diskCacheHeader
+}
+
+func TestChecksumStoredInHeader(t *testing.T) {
+	cache.Clear()
+	checksummingCache := NewDiskCache("test/cache", DiskCacheOptions{ChecksumAlgorithm: "sha256"})
+	getAndClose(t, checksummingCache, "aaaa", "some entry")
+
+	diskCacheHeader := readEntryHeader(t, "test/cache/aaaa")
+	expected := sha256.Sum256([]byte("some entry"))
+	if diskCacheHeader.Version != 2 || diskCacheHeader.ChecksumAlgorithm != "sha256" || !bytes.Equal(diskCacheHeader.Checksum, expected[:]) {
+		t.Errorf("expected a version 2 header with checksum %x, got %v", expected, diskCacheHeader)
+	}
+
+	// the entry should still pass the length check
+	if err := checkEntry("test/cache/aaaa", fileSize(t, "test/cache/aaaa")); err != nil {
+		t.Error(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestVerifyChecksumRefetchesCorruptEntries(t *testing.T) {
+	cache.Clear()
+	os.RemoveAll("test/cache/" + quarantineDirectory)
+	verifyingCache := NewDiskCache("test/cache", DiskCacheOptions{ChecksumAlgorithm: "sha256", VerifyChecksums: true})
+	getAndClose(t, verifyingCache, "aaaa", "some entry")
+
+	// flip the last byte of the body
+	data, err := ioutil.ReadFile("test/cache/aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile("test/cache/aaaa", data, 0644)
+
+	originalLogCacheError := logCacheError
+	var errorLogs []string
+	logCacheError = func(format string, a ...interface{}) { errorLogs = append(errorLogs, fmt.Sprintf(format, a...)) }
+
+	forwarded := false
+	res, err := verifyingCache.Get("aaaa", func() (*http.Response, error) {
+		forwarded = true
+		return cacheEntry200("some entry")()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if !forwarded {
+		t.Error("expected the corrupt entry to be fetched again")
+	}
+	if string(body) != "some entry" {
+		t.Errorf("expected the refetched body, got %q", body)
+	}
+	if len(errorLogs) != 1 || errorLogs[0][:55] != "Quarantining corrupt cache path test/cache/aaaa: body s" {
+		t.Errorf("unexpected error logs %v", errorLogs)
+	}
+	assertCached(t, "test/cache/"+quarantineDirectory+"/aaaa", true)
+
+	// and now it should be fine
+	forwarded = false
+	res, err = verifyingCache.Get("aaaa", func() (*http.Response, error) {
+		forwarded = true
+		return cacheEntry200("some entry")()
+	})
+	readAndClose(t, res, err)
+	if forwarded {
+		t.Error("expected the refetched entry to be served from the cache")
+	}
+
+	logCacheError = originalLogCacheError
+	os.RemoveAll("test/cache/" + quarantineDirectory)
+}
+
+type unreadableFile struct {
+	File
+}
+
+func (file unreadableFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EIO
+}
+
+func TestVerifyChecksumDoesNotQuarantineUnreadableEntries(t *testing.T) {
+	cache.Clear()
+	os.RemoveAll("test/cache/" + quarantineDirectory)
+	verifyingCache := NewDiskCache("test/cache", DiskCacheOptions{ChecksumAlgorithm: "sha256", VerifyChecksums: true})
+	getAndClose(t, verifyingCache, "aaaa", "some entry")
+
+	originalOsOpen := osOpen
+	osOpen = func(path string) (File, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return unreadableFile{file}, nil
+	}
+	originalLogCacheError := logCacheError
+	logCacheError = func(format string, a ...interface{}) {}
+
+	res, err := verifyingCache.Lookup("aaaa", 0)
+	if err == nil || res != nil {
+		t.Errorf("expected the unreadable entry to be treated as a miss, got %v %v", res, err)
+	}
+
+	osOpen = originalOsOpen
+	logCacheError = originalLogCacheError
+	assertCached(t, "test/cache/aaaa", true)
+	assertCached(t, "test/cache/"+quarantineDirectory+"/aaaa", false)
+}
+
+func TestReadsVersion1Entries(t *testing.T) {
+	cache.Clear()
+
+	// a version 1 header has no checksum fields
+	o := msgp.AppendMapHeader(nil, 4)
+	o = msgp.AppendString(o, "version")
+	o = msgp.AppendInt(o, 1)
+	o = msgp.AppendString(o, "status_code")
+	o = msgp.AppendInt(o, 200)
+	o = msgp.AppendString(o, "header")
+	o = msgp.AppendMapHeader(o, 1)
+	o = msgp.AppendString(o, "Content-Type")
+	o = msgp.AppendArrayHeader(o, 1)
+	o = msgp.AppendString(o, "text/plain")
+	o = msgp.AppendString(o, "content_length")
+	o = msgp.AppendInt64(o, 10)
+	ioutil.WriteFile("test/cache/aaaa", append(o, []byte("old entry!")...), 0644)
+
+	verifyingCache := NewDiskCache("test/cache", DiskCacheOptions{ChecksumAlgorithm: "sha256", VerifyChecksums: true})
+	res, err := verifyingCache.Get("aaaa", func() (*http.Response, error) {
+		t.Fatal("expected the version 1 entry to be served from the cache")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/plain" || string(body) != "old entry!" {
+		t.Errorf("version 1 entry was not read correctly: %v %q", res, body)
+	}
+}
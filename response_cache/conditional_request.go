@@ -0,0 +1,89 @@
+package response_cache
+
+import "io"
+import "net/http"
+import "time"
+
+// conditionalHeaders are the request headers that select part of a response, or whether to send
+// it at all, rather than a different response, so they need to be left out of the cache key and
+// applied to the cached response.
+var conditionalHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+
+// TakeConditionalHeaders removes and returns the range and conditional headers from the request,
+// so that the full response is requested from upstream and cached under the same key as other
+// requests.  only GET and HEAD requests are changed; the headers are left on other requests,
+// which we can't answer from the cached response.
+func TakeConditionalHeaders(req *http.Request) http.Header {
+	taken := make(http.Header)
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return taken
+	}
+	for _, key := range conditionalHeaders {
+		if values, ok := req.Header[key]; ok {
+			taken[key] = values
+			delete(req.Header, key)
+		}
+	}
+	return taken
+}
+
+// ServeConditional responds to a HEAD, range, or conditional request using the given cached
+// response, if possible; conditional requests are answered with 304 if the response's ETag or
+// Last-Modified header matches.  returns false without writing anything if the request was a
+// plain GET or some other method, or the response can't be used to answer it, in which case the
+// caller should send the full response as normal.
+//
+// the response body is closed if the request was served.  it may still be being filled, in which
+// case reads wait until the requested bytes have been written, but we need to know its length
+// to work out the ranges.
+func ServeConditional(rw http.ResponseWriter, req *http.Request, res *http.Response) bool {
+	if !conditionalRequest(req) || res.StatusCode != http.StatusOK {
+		return false
+	}
+	body, ok := res.Body.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	if _, err := body.Seek(0, io.SeekEnd); err != nil {
+		return false
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	defer res.Body.Close()
+
+	for key, values := range res.Header {
+		if key != "Content-Length" {
+			rw.Header()[key] = values
+		}
+	}
+
+	// don't let ServeContent sniff a content type that upstream didn't give
+	if _, ok := rw.Header()["Content-Type"]; !ok {
+		rw.Header()["Content-Type"] = nil
+	}
+
+	// ServeContent uses the modification time to validate If-Modified-Since and If-Range dates
+	modtime, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err != nil {
+		modtime = time.Time{}
+	}
+
+	http.ServeContent(rw, req, "", modtime, body)
+	return true
+}
+
+func conditionalRequest(req *http.Request) bool {
+	if req.Method == "HEAD" {
+		return true
+	}
+	if req.Method != "GET" {
+		return false
+	}
+	for _, key := range conditionalHeaders {
+		if req.Header.Get(key) != "" {
+			return true
+		}
+	}
+	return false
+}
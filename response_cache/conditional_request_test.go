@@ -0,0 +1,260 @@
+package response_cache
+
+import "testing"
+
+import "io"
+import "io/ioutil"
+import "mime"
+import "mime/multipart"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "strings"
+import "time"
+
+func rangeRequest(rangeHeader string, ifRange string) *http.Request {
+	req := httptest.NewRequest("GET", "http://example.com/pool/test.deb", nil)
+	req.Header.Set("Range", rangeHeader)
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	return req
+}
+
+func serveConditionalFromCache(t *testing.T, req *http.Request, miss func() (*http.Response, error)) *httptest.ResponseRecorder {
+	res, err := cache.Get("aaaa", miss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	if !ServeConditional(recorder, req, res) {
+		t.Fatal("expected the request to be served")
+	}
+	return recorder
+}
+
+func taggedEntry200(body string) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		res, err := cacheEntry200(body)()
+		res.Header.Set("ETag", `"v1"`)
+		res.Header.Set("Content-Type", "application/octet-stream")
+		return res, err
+	}
+}
+
+func TestTakeConditionalHeaders(t *testing.T) {
+	req := rangeRequest("bytes=0-1", `"v1"`)
+	req.Header.Set("If-None-Match", `"v1"`)
+	req.Header.Set("Accept", "*/*")
+	taken := TakeConditionalHeaders(req)
+	if taken.Get("Range") != "bytes=0-1" || taken.Get("If-Range") != `"v1"` || taken.Get("If-None-Match") != `"v1"` {
+		t.Errorf("expected the conditional headers to be returned, got %v", taken)
+	}
+	if len(req.Header) != 1 || req.Header.Get("Accept") != "*/*" {
+		t.Errorf("expected only the conditional headers to be removed, got %v", req.Header)
+	}
+}
+
+func TestConditionalHeadersOnlyAppliedToGetAndHead(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "Test response body.")
+	res, err := cache.Get("aaaa", cacheEntry200("Test response body."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	req := httptest.NewRequest("POST", "http://example.com/repo.git/git-upload-pack", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	if taken := TakeConditionalHeaders(req); len(taken) != 0 || req.Header.Get("Range") != "bytes=0-1" {
+		t.Errorf("expected the headers to be left on the POST request, took %v", taken)
+	}
+	if ServeConditional(httptest.NewRecorder(), req, res) {
+		t.Error("expected a POST request not to be served as a range request")
+	}
+}
+
+func TestServeRangeFromCachedEntry(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "Test response body.")
+
+	recorder := serveConditionalFromCache(t, rangeRequest("bytes=5-12", ""), nil)
+	if recorder.Code != 206 {
+		t.Fatalf("expected 206, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Content-Range") != "bytes 5-12/19" {
+		t.Errorf("expected Content-Range bytes 5-12/19, got %q", recorder.Header().Get("Content-Range"))
+	}
+	if recorder.Body.String() != "response" {
+		t.Errorf("expected %q, got %q", "response", recorder.Body.String())
+	}
+}
+
+func TestServeMultipleRangesFromCachedEntry(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "Test response body.")
+
+	recorder := serveConditionalFromCache(t, rangeRequest("bytes=0-3,-5", ""), nil)
+	if recorder.Code != 206 {
+		t.Fatalf("expected 206, got %d", recorder.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected a multipart/byteranges response, got %q", recorder.Header().Get("Content-Type"))
+	}
+
+	expected := []struct{ contentRange, body string }{
+		{"bytes 0-3/19", "Test"},
+		{"bytes 14-18/19", "body."},
+	}
+	parts := multipart.NewReader(recorder.Body, params["boundary"])
+	for _, expectedPart := range expected {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Range") != expectedPart.contentRange || string(data) != expectedPart.body {
+			t.Errorf("expected part %v, got %q %q", expectedPart, part.Header.Get("Content-Range"), data)
+		}
+	}
+}
+
+func TestServeRangeChecksIfRange(t *testing.T) {
+	cache.Clear()
+	res, err := cache.Get("aaaa", taggedEntry200("Test response body."))
+	readAndClose(t, res, err)
+
+	recorder := serveConditionalFromCache(t, rangeRequest("bytes=5-12", `"v1"`), nil)
+	if recorder.Code != 206 || recorder.Body.String() != "response" {
+		t.Errorf("expected a partial response when If-Range matches, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serveConditionalFromCache(t, rangeRequest("bytes=5-12", `"v2"`), nil)
+	if recorder.Code != 200 || recorder.Body.String() != "Test response body." {
+		t.Errorf("expected the full response when If-Range doesn't match, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("ETag") != `"v1"` || recorder.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("expected the cached headers to be sent, got %v", recorder.Header())
+	}
+}
+
+func TestServeRangeFromEntryBeingFilled(t *testing.T) {
+	cache.Clear()
+
+	body := "Test response body being filled."
+	reader, writer := io.Pipe()
+	filling := func() (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{},
+			ContentLength: int64(len(body)),
+			Body:          reader,
+		}, nil
+	}
+
+	go func() {
+		writer.Write([]byte(body[:10]))
+		time.Sleep(50 * time.Millisecond)
+		writer.Write([]byte(body[10:]))
+		writer.Close()
+	}()
+
+	// the range asked for hasn't been written yet when we start serving it
+	recorder := serveConditionalFromCache(t, rangeRequest("bytes=14-17", ""), filling)
+	if recorder.Code != 206 || recorder.Body.String() != "body" {
+		t.Errorf("expected a partial response, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Range") != "bytes 14-17/32" {
+		t.Errorf("expected Content-Range bytes 14-17/32, got %q", recorder.Header().Get("Content-Range"))
+	}
+
+	waitForFollowerToFinish("test/cache/aaaa")
+	assertCached(t, "test/cache/aaaa", true)
+}
+
+func TestServeConditionalIgnoresPlainRequests(t *testing.T) {
+	cache.Clear()
+	res, err := cache.Get("aaaa", cacheEntry200("Test response body."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/pool/test.deb", nil)
+	recorder := httptest.NewRecorder()
+	if ServeConditional(recorder, req, res) {
+		t.Error("expected a plain GET request not to be served")
+	}
+	if data, _ := ioutil.ReadAll(res.Body); !strings.HasPrefix(string(data), "Test") {
+		t.Errorf("expected the body to be left for the caller, got %q", data)
+	}
+}
+
+func newConditionalRequest(method string, header string, value string) *http.Request {
+	req := httptest.NewRequest(method, "http://example.com/pool/test.deb", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	return req
+}
+
+func TestServeConditionalAnswersNotModified(t *testing.T) {
+	cache.Clear()
+	res, err := cache.Get("aaaa", func() (*http.Response, error) {
+		res, err := taggedEntry200("Test response body.")()
+		res.Header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		return res, err
+	})
+	readAndClose(t, res, err)
+
+	for _, req := range []*http.Request{
+		newConditionalRequest("GET", "If-None-Match", `"v1"`),
+		newConditionalRequest("GET", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"),
+	} {
+		recorder := serveConditionalFromCache(t, req, nil)
+		if recorder.Code != 304 || recorder.Body.Len() != 0 {
+			t.Errorf("expected 304 for %v, got %d %q", req.Header, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	for _, req := range []*http.Request{
+		newConditionalRequest("GET", "If-None-Match", `"v2"`),
+		newConditionalRequest("GET", "If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT"),
+	} {
+		recorder := serveConditionalFromCache(t, req, nil)
+		if recorder.Code != 200 || recorder.Body.String() != "Test response body." {
+			t.Errorf("expected the full response for %v, got %d %q", req.Header, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestServeConditionalAnswersHeadFromHeader(t *testing.T) {
+	cache.Clear()
+	res, err := cache.Get("aaaa", taggedEntry200("Test response body."))
+	readAndClose(t, res, err)
+
+	res, err = cache.Lookup("aaaa", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	if !ServeConditional(recorder, newConditionalRequest("HEAD", "", ""), res) {
+		t.Fatal("expected the HEAD request to be served")
+	}
+	if recorder.Code != 200 || recorder.Body.Len() != 0 {
+		t.Errorf("expected 200 with no body, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Length") != "19" || recorder.Header().Get("ETag") != `"v1"` {
+		t.Errorf("expected the cached headers, got %v", recorder.Header())
+	}
+}
+
+func TestLookupDoesNotFetch(t *testing.T) {
+	cache.Clear()
+	res, err := cache.Lookup("aaaa", 0)
+	if !os.IsNotExist(err) || res != nil {
+		t.Errorf("expected a not exist error, got %v %v", res, err)
+	}
+	assertCached(t, "test/cache/aaaa", false)
+}
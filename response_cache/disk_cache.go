@@ -1,29 +1,90 @@
 package response_cache
 
+import "bytes"
 import "errors"
 import "fmt"
 import "io"
+import "math"
 import "github.com/tinylib/msgp/msgp"
 import "net/http"
 import "sync"
+import "sync/atomic"
 import "os"
+import "time"
 
 // error injection functions
 var osOpen = func(path string) (File, error) { return os.Open(path) }
 var osCreate = func(path string) (File, error) { return os.Create(path) }
 var logCacheError = func(format string, a ...interface{}) { fmt.Fprintf(os.Stderr, format, a...) }
+var statFilesystem = freeSpace
+
+type DiskCacheOptions struct {
+	// evict the least recently used entries once the total size of the entries exceeds this
+	// many bytes; 0 means no limit
+	MaxSize int64
+
+	// don't store new entries if the cache filesystem has less than this many bytes or inodes
+	// free; 0 means no minimum
+	MinFreeBytes  uint64
+	MinFreeInodes uint64
+
+	// checksum the body of new entries using this algorithm; "" means don't checksum
+	ChecksumAlgorithm string
+
+	// verify the checksum of entries that have one before serving them
+	VerifyChecksums bool
+
+	// if every client waiting for a new entry disconnects before it is this percent complete, stop
+	// fetching it; 0 means always finish.  entries of unknown length are always abandoned.
+	AbandonFillsUnder int
+
+	// if fetching an expired entry again fails, serve the expired entry instead, with a Warning
+	// header
+	ServeStaleOnError bool
+
+	// rescan the cache directory for leftover temporary files and corrupt entries this often, in
+	// addition to the scan on startup; 0 means only scan on startup
+	ScanInterval time.Duration
+}
 
 type diskCache struct {
 	cacheDirectory        string
+	options               DiskCacheOptions
 	progressTrackersMutex sync.Mutex
 	progressTrackers      map[string]chan func() (*http.Response, error)
+	refreshFailures       map[string]time.Time
+	index                 *cacheIndex
+	evictions             chan struct{}
+	scanned               chan struct{}
+	lowSpace              uint32
 }
 
-func NewDiskCache(cacheDirectory string) ResponseCache {
-	return &diskCache{
+// NewDiskCache returns a ResponseCache that stores entries in the given directory.  If a MaxSize
+// is given, the least recently used entries will be evicted in the background whenever the total
+// size of the entries exceeds it.  The existing entries are scanned and indexed in the background,
+// so requests can be served straight away.
+func NewDiskCache(cacheDirectory string, options DiskCacheOptions) ResponseCache {
+	cache := &diskCache{
 		cacheDirectory:   cacheDirectory,
+		options:          options,
 		progressTrackers: make(map[string]chan func() (*http.Response, error)),
+		refreshFailures:  make(map[string]time.Time),
+		index:            newCacheIndex(),
+		evictions:        make(chan struct{}, 1),
+		scanned:          make(chan struct{}),
+	}
+
+	if options.MaxSize > 0 {
+		go cache.evictor()
+	}
+
+	go cache.initialScan()
+
+	if options.ScanInterval > 0 {
+		go cache.scanPeriodically()
 	}
+
+	return cache
 }
 
 func (cache *diskCache) cacheEntryPath(key string) string {
@@ -31,30 +92,231 @@ func (cache *diskCache) cacheEntryPath(key string) string {
 }
 
 func (cache *diskCache) Get(key string, miss func() (*http.Response, error)) (*http.Response, error) {
+	return cache.GetFresh(key, 0, miss)
+}
+
+func (cache *diskCache) GetFresh(key string, maxAge time.Duration, miss func() (*http.Response, error)) (*http.Response, error) {
+	return cache.GetRevalidated(key, maxAge, func(validators http.Header) (*http.Response, error) { return miss() })
+}
+
+func (cache *diskCache) GetRevalidated(key string, maxAge time.Duration, fetch func(validators http.Header) (*http.Response, error)) (*http.Response, error) {
 	path := cache.cacheEntryPath(key)
+	var stale File
 
 	for {
-		// optimistically try to open the entry in the cache, so we don't need to mutex
-		file, err := osOpen(path)
-
+		file, err := cache.openEntry(path)
 		if err == nil {
-			return cache.cachedResponse(file)
-		}
+			if !cache.expired(path, maxAge) {
+				cache.discardStale(path, stale)
+				return cache.cachedResponse(path, &completeEntry{file})
+			}
 
-		if !os.IsNotExist(err) {
+			// fetch it again, but hang on to the expired entry in case we can't
+			cache.discardStale(path, stale)
+			stale = file
+		} else if !os.IsNotExist(err) {
 			logCacheError("Error opening cache path %s for reading: %s\n", path, err)
 		}
 
 		// cache miss
-		readFunction, ok := <-cache.channelFor(path, miss)
+		waitingSince := time.Now()
+		readFunction, ok := <-cache.channelFor(path, cache.revalidate(path, stale, fetch))
 		if ok {
-			return readFunction()
+			res, err := readFunction()
+			if err == errNotModified || err == Aliased {
+				// the expired entry has been marked as fresh again, or an entry has been linked
+				// into place, so loop around and serve it
+				continue
+			}
+			if stale != nil && cache.options.ServeStaleOnError && refreshFailed(res, err) {
+				return cache.staleResponse(path, stale, res, err)
+			}
+			cache.discardStale(path, stale)
+			return res, err
+		}
+		if stale != nil && cache.options.ServeStaleOnError && cache.refreshFailedSince(path, waitingSince) {
+			// the fill we were waiting for couldn't refresh the entry either, so don't try again
+			return cache.staleResponse(path, stale, nil, errRefreshFailed)
 		}
 		// we missed the forwarding function's execution, which is fine because now it will have stored into the cache.
 		// loop around and try again - having to loop is the price we pay for being optimistic and avoiding the mutex above.
 	}
 }
 
+// revalidate returns a miss function that asks the upstream server whether the expired entry is
+// still current, if it has an ETag or Last-Modified header.  if the server says it hasn't been
+// modified, we mark the entry as fresh again and return errNotModified instead of a response.
+func (cache *diskCache) revalidate(path string, stale File, fetch func(validators http.Header) (*http.Response, error)) func() (*http.Response, error) {
+	validators := make(http.Header)
+	if stale != nil {
+		header, _, err := decodeHeader(&entryHeaderReader{entryReader: &completeEntry{stale}})
+		if err == nil && header.StatusCode == http.StatusOK {
+			if etag := http.Header(header.Header).Get("ETag"); etag != "" {
+				validators.Set("If-None-Match", etag)
+			}
+			if lastModified := http.Header(header.Header).Get("Last-Modified"); lastModified != "" {
+				validators.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	return func() (*http.Response, error) {
+		res, err := fetch(validators)
+		if stale != nil {
+			cache.recordRefresh(path, refreshFailed(res, err))
+		}
+		if err != nil || res.StatusCode != http.StatusNotModified || len(validators) == 0 {
+			return res, err
+		}
+		res.Body.Close()
+
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			return nil, err
+		}
+		return nil, errNotModified
+	}
+}
+
+func (cache *diskCache) expired(path string, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) > maxAge
+}
+
+func (cache *diskCache) discardStale(path string, stale File) {
+	if stale != nil {
+		stale.Close()
+		cache.index.release(path)
+	}
+}
+
+// refreshFailed returns true if we couldn't fetch an expired entry again, as opposed to getting a
+// response that we can't cache.
+func refreshFailed(res *http.Response, err error) bool {
+	if err != nil && err != Uncacheable && err != LowDiskSpace {
+		return true
+	}
+	return res != nil && res.StatusCode >= 500
+}
+
+// recordRefresh notes whether an attempt to refresh the expired entry failed, so that the other
+// clients that were waiting for the same fill can serve the expired entry instead of trying again.
+func (cache *diskCache) recordRefresh(path string, failed bool) {
+	cache.progressTrackersMutex.Lock()
+	defer cache.progressTrackersMutex.Unlock()
+
+	if failed {
+		cache.refreshFailures[path] = time.Now()
+	} else {
+		delete(cache.refreshFailures, path)
+	}
+}
+
+// refreshFailedSince returns true if an attempt to refresh the expired entry failed after the
+// given time.
+func (cache *diskCache) refreshFailedSince(path string, since time.Time) bool {
+	cache.progressTrackersMutex.Lock()
+	defer cache.progressTrackersMutex.Unlock()
+
+	failed, ok := cache.refreshFailures[path]
+	return ok && !failed.Before(since)
+}
+
+// staleResponse returns the expired entry and ServedStale, with a warning header to say that it
+// couldn't be refreshed.
+func (cache *diskCache) staleResponse(path string, stale File, res *http.Response, err error) (*http.Response, error) {
+	if res != nil {
+		res.Body.Close()
+		err = errors.New(res.Status)
+	}
+	logCacheError("Error refreshing cache path %s, serving stale entry: %s\n", path, err)
+
+	staleRes, err := cache.cachedResponse(path, &completeEntry{stale})
+	if err != nil {
+		return nil, err
+	}
+	if staleRes.Header == nil {
+		staleRes.Header = make(http.Header)
+	}
+	staleRes.Header.Add("Warning", `111 - "Revalidation Failed"`)
+	return staleRes, ServedStale
+}
+
+func (cache *diskCache) Lookup(key string, maxAge time.Duration) (*http.Response, error) {
+	path := cache.cacheEntryPath(key)
+
+	file, err := cache.openEntry(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logCacheError("Error opening cache path %s for reading: %s\n", path, err)
+		}
+		return nil, err
+	}
+	if cache.expired(path, maxAge) {
+		cache.discardStale(path, file)
+		return nil, os.ErrNotExist
+	}
+	return cache.cachedResponse(path, &completeEntry{file})
+}
+
+// Alias publishes the old entry's file under the new key too, and adds it to the index.
+func (cache *diskCache) Alias(oldKey string, newKey string) (bool, error) {
+	oldPath, newPath := cache.cacheEntryPath(oldKey), cache.cacheEntryPath(newKey)
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		return false, err
+	}
+	info, err := os.Stat(oldPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// link rather than rename, so that processes still using the old key format can share the
+	// cache directory; the entry is counted twice towards the cache size until one is evicted
+	if err := os.Link(oldPath, newPath); os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		logCacheError("Error linking cache path %s to %s: %s\n", oldPath, newPath, err)
+		return false, err
+	}
+	if total := cache.index.published(newPath, info.Size(), time.Now()); cache.options.MaxSize > 0 && total > cache.options.MaxSize {
+		cache.needsEviction()
+	}
+	return true, nil
+}
+
+// openEntry opens the given cache entry, if it has been published.  the entry is acquired from the
+// index if successful, and must be released when the file is closed.
+func (cache *diskCache) openEntry(path string) (File, error) {
+	// optimistically try to open the entry in the cache, so we don't need to mutex; we do need to
+	// mark the entry as in use first though, so that it isn't evicted out from under us
+	cache.index.acquire(path)
+	file, err := osOpen(path)
+
+	if err == nil && cache.options.VerifyChecksums {
+		if err = verifyChecksum(file); err != nil {
+			file.Close()
+			if _, mismatch := err.(checksumMismatch); mismatch {
+				// treat the entry as missing, and fetch it again
+				cache.index.release(path)
+				cache.quarantine(path, err)
+				return nil, os.ErrNotExist
+			}
+			// we couldn't read the entry, which doesn't mean it's corrupt; treat it as a miss for now
+		}
+	}
+
+	if err != nil {
+		cache.index.release(path)
+		return nil, err
+	}
+	return file, nil
+}
+
 func (cache *diskCache) channelFor(path string, miss func() (*http.Response, error)) chan func() (*http.Response, error) {
 	cache.progressTrackersMutex.Lock()
 	defer cache.progressTrackersMutex.Unlock()
@@ -79,74 +341,230 @@ func release(sf *SharedFile) {
 	}
 }
 
+func spawnReader(sf *SharedFile) *blockingReader {
+	reader, err := sf.spawnBlockingReader()
+	if err != nil {
+		// spawnBlockingReader can only fail if reference fails, and reference can only fail if the reference count dropped to 0, which
+		// isn't possible since we only decrement for the writer itself in the call to release deferred to the end of populate
+		panic(err)
+	}
+	return reader
+}
+
+// worthFinishing returns true if a fill that nobody is waiting for any more is far enough along
+// that we should finish it anyway.
+func (cache *diskCache) worthFinishing(written int64, contentLength int64) bool {
+	if cache.options.AbandonFillsUnder <= 0 {
+		return true
+	}
+	if contentLength <= 0 {
+		return false
+	}
+	return written*100 >= contentLength*int64(cache.options.AbandonFillsUnder)
+}
+
 func (cache *diskCache) populate(path string, ch chan func() (*http.Response, error), miss func() (*http.Response, error)) {
 	var sf *SharedFile
-	defer release(sf)
+	defer func() { release(sf) }()
 	defer close(ch)
 
+	// if another process sharing the cache directory is already filling this entry, follow along
+	// with it rather than downloading it again ourselves
+	lock, err := lockEntry(path)
+	if err == errEntryLocked {
+		cache.followFill(path, ch)
+		return
+	} else if err != nil {
+		logCacheError("Error locking cache path %s: %s\n", path, err)
+	}
+
+	// we must release the lock before letting other waiters in this process try again, or they'll
+	// think another process is filling the entry
+	var finishedOnce sync.Once
+	finished := func() {
+		finishedOnce.Do(func() {
+			if lock != nil {
+				lock.release()
+			}
+			cache.clearProgressTrackerFor(path)
+		})
+	}
+
 	// forward the request upstream
 	res, err := miss()
 
+	// if we couldn't get a response, send the error back to just 1 waiter, the same as uncacheable
+	// responses below
+	if err != nil && err != Uncacheable {
+		finished()
+		ch <- func() (*http.Response, error) { return nil, err }
+		return
+	}
+
 	// if uncacheable, send the response back to just 1 waiter, and close the channel to let others know there's no point waiting
-	if !CacheableResponse(res.StatusCode, res.Header) {
+	// (the miss function may also tell us not to cache the response)
+	if err == Uncacheable || !CacheableResponse(res.StatusCode, res.Header) {
+		finished()
 		ch <- func() (*http.Response, error) { return res, Uncacheable }
-		cache.clearProgressTrackerFor(path)
 		return
 	}
 
-	// open a temporary file to write to
-	tempPath := path + ".temp"
+	// if the disk is nearly full, don't start writing something we probably can't finish; like
+	// uncacheable responses, send the response back to just 1 waiter
+	if !cache.enoughSpace() {
+		finished()
+		ch <- func() (*http.Response, error) { return res, LowDiskSpace }
+		return
+	}
+
+	// open a temporary file to write to; other processes may be filling other entries in the same
+	// directory, so use a unique name
+	tempPath := uniqueTempPath(path)
+	if lock != nil {
+		if err := lock.setTempPath(tempPath); err != nil {
+			logCacheError("Error writing to lock for cache path %s: %s\n", path, err)
+		}
+	}
 	file, err := osCreate(tempPath)
-	sf = NewSharedFile(file)
 
 	if err != nil {
 		logCacheError("Error opening cache path %s for writing: %s\n", path, err)
 	} else {
-		err = cache.writeHeader(sf, res)
+		sf = NewSharedFile(file)
+		// if writing fails, the readers find out straight away, and must be able to try again
+		sf.beforeFailing = finished
+		err = cache.writeHeader(sf, res, cache.options.ChecksumAlgorithm)
 		if err != nil {
 			logCacheError("Error writing to cache path %s: %s\n", path, err)
+			os.Remove(tempPath)
 		}
 	}
 
 	// if we can't open that file or write the header to it, handle it like we did above for uncacheable files to minimize client suffering
 	// we've already logged the IO error, so don't return it - it has no further impact
 	if err != nil {
+		finished()
 		ch <- func() (*http.Response, error) { return res, nil }
-		cache.clearProgressTrackerFor(path)
 		return
 	}
 
+	// the checksum is the last thing in the header, so we can fill it in once we've written the body
+	headerLength := sf.length
+	checksum := newChecksum(cache.options.ChecksumAlgorithm)
+	var checksumOffset int64
+	if checksum != nil {
+		checksumOffset = headerLength - int64(checksum.Size())
+	}
+
 	done := make(chan interface{})
+	var abandoned int32
 
 	// copy the response body to the cache
 	go func() {
-		n, err := io.Copy(sf, res.Body)
+		var body io.Reader = res.Body
+		if checksum != nil {
+			body = io.TeeReader(res.Body, checksum)
+		}
+		n, err := io.Copy(sf, body)
+		if err == nil && checksum != nil && (res.ContentLength < 0 || n == res.ContentLength) {
+			_, err = sf.WriteAt(checksum.Sum(nil), checksumOffset)
+		}
 		if err != nil {
 			// unfortunately, we can't tell if the error came from reading or writing; we'd ideally only log errors from writing
-			logCacheError("Error copying response to cache path %s: %s\n", path, err)
-			cache.clearProgressTrackerFor(path)
+			if atomic.LoadInt32(&abandoned) == 0 {
+				logCacheError("Error copying response to cache path %s: %s\n", path, err)
+			}
+			finished()
 			sf.Abort(err)
+			os.Remove(tempPath)
 		} else if res.ContentLength > 0 && n != res.ContentLength {
-			cache.clearProgressTrackerFor(path)
+			finished()
 			sf.Abort(errors.New(fmt.Sprintf("response should have been %d bytes but was only %d bytes", res.ContentLength, n)))
+			os.Remove(tempPath)
 		} else {
 			// publish the result in the cache
 			sf.Sync()
 			err = os.Rename(tempPath, path)
+			finished()
 			sf.Close()
-			cache.clearProgressTrackerFor(path)
+			if err != nil {
+				logCacheError("Error publishing cache path %s: %s\n", path, err)
+			} else if total := cache.index.published(path, sf.length, time.Now()); cache.options.MaxSize > 0 && total > cache.options.MaxSize {
+				cache.needsEviction()
+			}
+		}
+		close(done)
+	}()
+
+	// hand out readers to the waiters until the body has been copied.  we spawn each reader before
+	// offering it, so that if the reference count drops to just the writer and the next reader, we
+	// know that nobody is waiting for the response any more.  (we can't tell if readers in other
+	// processes are following the fill, so we may abandon fills they were waiting for.)
+	var next *blockingReader
+	for {
+		if next == nil {
+			next = spawnReader(sf)
+		}
+		reader := next
+		readFunction := func() (*http.Response, error) {
+			cache.index.acquire(path)
+			return cache.cachedResponse(path, reader)
+		}
+
+		select {
+		case ch <- readFunction:
+			next = nil
+
+		case <-sf.unreferenced:
+			if refs, written := sf.references(); refs <= 2 && !cache.worthFinishing(written-headerLength, res.ContentLength) {
+				// closing the body will make the copy fail, which will abort the fill
+				atomic.StoreInt32(&abandoned, 1)
+				res.Body.Close()
+				next.Close()
+				<-done
+				return
+			}
+
+		case <-done:
+			next.Close()
+			return
 		}
+	}
+}
+
+// followFill hands out readers that tail the temporary file another process is filling the entry
+// in, until that process finishes.
+func (cache *diskCache) followFill(path string, ch chan func() (*http.Response, error)) {
+	defer cache.clearProgressTrackerFor(path)
+
+	// the other process records the temporary file path as soon as it has the lock, but we may
+	// have got in between the two
+	var tempPath string
+	for tempPath == "" {
+		var err error
+		tempPath, err = lockedTempPath(path)
+		if err != nil || (tempPath == "" && !entryLocked(path)) {
+			// the other process has finished already, so the waiters can try again
+			return
+		} else if tempPath == "" {
+			time.Sleep(tailPollInterval)
+		}
+	}
+
+	done := make(chan interface{})
+	go func() {
+		waitForFill(path, tempPath)
 		close(done)
 	}()
 
 	readFunction := func() (*http.Response, error) {
-		reader, err := sf.SpawnReader()
+		cache.index.acquire(path)
+		reader, err := openTail(path, tempPath)
 		if err != nil {
-			// SpawnReader can only fail if reference fails, and reference can only fail if the reference count dropped to 0, which
-			// isn't possible since we only decrement for the writer itself in the call to release deferred to the end of this method
-			panic(err)
+			cache.index.release(path)
+			return nil, err
 		}
-		return cache.cachedResponse(reader)
+		return cache.cachedResponse(path, reader)
 	}
 
 	for {
@@ -160,14 +578,20 @@ func (cache *diskCache) populate(path string, ch chan func() (*http.Response, er
 	}
 }
 
-func (cache *diskCache) writeHeader(w io.Writer, res *http.Response) error {
+func (cache *diskCache) writeHeader(w io.Writer, res *http.Response, checksumAlgorithm string) error {
 	diskCacheHeader := DiskCacheHeader{
-		Version:       1,
+		Version:       2,
 		StatusCode:    res.StatusCode,
 		Header:        res.Header,
 		ContentLength: res.ContentLength,
 	}
 
+	// write a placeholder of the right length, since we don't know the checksum until we've written the body
+	if checksum := newChecksum(checksumAlgorithm); checksum != nil {
+		diskCacheHeader.ChecksumAlgorithm = checksumAlgorithm
+		diskCacheHeader.Checksum = make([]byte, checksum.Size())
+	}
+
 	streamer := msgp.NewWriter(w)
 
 	if err := diskCacheHeader.EncodeMsg(streamer); err != nil {
@@ -181,28 +605,143 @@ func (cache *diskCache) writeHeader(w io.Writer, res *http.Response) error {
 	return nil
 }
 
-func (cache *diskCache) cachedResponse(r io.ReadCloser) (*http.Response, error) {
-	// wrap the file reader in a msgpack reader so we can decode the header
-	streamer := msgp.NewReader(r)
+// cachedResponse returns a response that reads from the given cache entry.  the entry must have
+// been acquired from the index; it will be released when the response body is closed.
+func (cache *diskCache) cachedResponse(path string, r entryReader) (*http.Response, error) {
+	release := func() { cache.index.release(path) }
 
-	var diskCacheHeader DiskCacheHeader
-	if err := diskCacheHeader.DecodeMsg(streamer); err != nil {
+	diskCacheHeader, headerLength, err := decodeHeader(&entryHeaderReader{entryReader: r})
+	if err != nil {
+		r.Close()
+		release()
 		return nil, err
 	}
 
-	// although the remainder of the file is just the raw body and is not msgpacked, we have to
-	// keep using the msgpack reader object as it may have some bytes in its buffer, so we return
-	// reader rather than r as the Body stream.  we have to combine that back with the io.Closer
-	// interface from r, because msgp.NewReader returns an io.Reader rather than io.ReadCloser.
+	// if the response was chunked, we can still tell how long it was once it's been cached
+	size := diskCacheHeader.ContentLength
+	if complete, ok := r.(*completeEntry); ok && size < 0 {
+		if length, ok := complete.length(); ok {
+			size = length - headerLength
+		}
+	}
+
 	return &http.Response{
 		StatusCode:    diskCacheHeader.StatusCode,
 		Header:        diskCacheHeader.Header,
 		ContentLength: diskCacheHeader.ContentLength,
-		Body:          ReaderAndCloser(streamer, r),
+		Body:          &entryBody{reader: r, start: headerLength, size: size, release: release},
 	}, nil
 }
 
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.n += int64(n)
+	return n, err
+}
+
+// decodeHeader reads the header from the start of a cache entry, and returns it along with the
+// number of bytes it occupied.
+func decodeHeader(r io.Reader) (diskCacheHeader DiskCacheHeader, headerLength int64, err error) {
+	counter := &countingReader{Reader: r}
+	streamer := msgp.NewReader(counter)
+
+	if err = diskCacheHeader.DecodeMsg(streamer); err != nil {
+		return
+	}
+
+	// the msgpack reader buffers ahead, so discount whatever it has read but not yet consumed
+	headerLength = counter.n - int64(streamer.Buffered())
+	return
+}
+
+// checksumMismatch is returned by verifyChecksum if the entry's body doesn't match its checksum, as
+// opposed to other errors reading the entry, which don't mean that it's corrupt.
+type checksumMismatch string
+
+func (err checksumMismatch) Error() string {
+	return string(err)
+}
+
+// verifyChecksum reads the body of the cache entry and checks it against the checksum stored in
+// its header, if there is one.  it uses ReadAt so that the file can then be read from the start.
+func verifyChecksum(file File) error {
+	diskCacheHeader, headerLength, err := decodeHeader(io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		return err
+	}
+
+	checksum := newChecksum(diskCacheHeader.ChecksumAlgorithm)
+	if checksum == nil || len(diskCacheHeader.Checksum) == 0 {
+		// entries written before version 2 or with checksums turned off can't be verified
+		return nil
+	}
+
+	if _, err := io.Copy(checksum, io.NewSectionReader(file, headerLength, math.MaxInt64-headerLength)); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(checksum.Sum(nil), diskCacheHeader.Checksum) {
+		return checksumMismatch(fmt.Sprintf("body %s checksum is %x but should be %x", diskCacheHeader.ChecksumAlgorithm, checksum.Sum(nil), diskCacheHeader.Checksum))
+	}
+
+	return nil
+}
+
+func (cache *diskCache) needsEviction() {
+	select {
+	case cache.evictions <- struct{}{}:
+	default:
+		// the evictor already has a pending run
+	}
+}
+
+func (cache *diskCache) evictor() {
+	for range cache.evictions {
+		cache.index.evict(cache.options.MaxSize, os.Remove)
+	}
+}
+
+// enoughSpace checks the free space watermarks, logging when the cache filesystem goes below or
+// comes back above them.
+func (cache *diskCache) enoughSpace() bool {
+	if cache.options.MinFreeBytes == 0 && cache.options.MinFreeInodes == 0 {
+		return true
+	}
+
+	freeBytes, freeInodes, err := statFilesystem(cache.cacheDirectory)
+	if err != nil {
+		// we'll find out soon enough if we really can't write to the cache
+		logCacheError("Error checking free space for cache directory %s: %s\n", cache.cacheDirectory, err)
+		return true
+	}
+
+	enough := freeBytes >= cache.options.MinFreeBytes && freeInodes >= cache.options.MinFreeInodes
+
+	if !enough && atomic.CompareAndSwapUint32(&cache.lowSpace, 0, 1) {
+		logCacheError("Cache directory %s is low on space (%d bytes, %d inodes free), bypassing cache\n", cache.cacheDirectory, freeBytes, freeInodes)
+	} else if enough && atomic.CompareAndSwapUint32(&cache.lowSpace, 1, 0) {
+		logCacheError("Cache directory %s has space again (%d bytes, %d inodes free), resuming caching\n", cache.cacheDirectory, freeBytes, freeInodes)
+	}
+
+	return enough
+}
+
+// Health checks the free space itself, so that it reports when space runs low or is freed up
+// even if nothing is being fetched.
+func (cache *diskCache) Health() error {
+	if !cache.enoughSpace() {
+		return LowDiskSpace
+	}
+	return nil
+}
+
 func (cache *diskCache) Clear() error {
+	defer cache.index.reset()
 	return clearDirectory(cache.cacheDirectory)
 }
 
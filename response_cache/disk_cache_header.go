@@ -10,4 +10,9 @@ type DiskCacheHeader struct {
 	Header map[string][]string `msg:"header"`
 
 	ContentLength int64 `msg:"content_length"`
+
+	// added in version 2.  the checksum is filled in once the body has been written, so it must
+	// remain the last field to allow it to be overwritten in place.
+	ChecksumAlgorithm string `msg:"checksum_algorithm"`
+	Checksum          []byte `msg:"checksum"`
 }
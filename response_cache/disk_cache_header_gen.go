@@ -78,6 +78,16 @@ func (z *DiskCacheHeader) DecodeMsg(dc *msgp.Reader) (err error) {
 			if err != nil {
 				return
 			}
+		case "checksum_algorithm":
+			z.ChecksumAlgorithm, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "checksum":
+			z.Checksum, err = dc.ReadBytes(z.Checksum)
+			if err != nil {
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -90,9 +100,9 @@ func (z *DiskCacheHeader) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *DiskCacheHeader) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 4
+	// map header, size 6
 	// write "version"
-	err = en.Append(0x84, 0xa7, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	err = en.Append(0x86, 0xa7, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
 	if err != nil {
 		return err
 	}
@@ -143,15 +153,33 @@ func (z *DiskCacheHeader) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	// write "checksum_algorithm"
+	err = en.Append(0xb2, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d)
+	if err != nil {
+		return err
+	}
+	err = en.WriteString(z.ChecksumAlgorithm)
+	if err != nil {
+		return
+	}
+	// write "checksum"
+	err = en.Append(0xa8, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d)
+	if err != nil {
+		return err
+	}
+	err = en.WriteBytes(z.Checksum)
+	if err != nil {
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *DiskCacheHeader) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 4
+	// map header, size 6
 	// string "version"
-	o = append(o, 0x84, 0xa7, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	o = append(o, 0x86, 0xa7, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
 	o = msgp.AppendInt(o, z.Version)
 	// string "status_code"
 	o = append(o, 0xab, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x5f, 0x63, 0x6f, 0x64, 0x65)
@@ -169,6 +197,12 @@ func (z *DiskCacheHeader) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "content_length"
 	o = append(o, 0xae, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x5f, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68)
 	o = msgp.AppendInt64(o, z.ContentLength)
+	// string "checksum_algorithm"
+	o = append(o, 0xb2, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d)
+	o = msgp.AppendString(o, z.ChecksumAlgorithm)
+	// string "checksum"
+	o = append(o, 0xa8, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d)
+	o = msgp.AppendBytes(o, z.Checksum)
 	return
 }
 
@@ -242,6 +276,16 @@ func (z *DiskCacheHeader) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			if err != nil {
 				return
 			}
+		case "checksum_algorithm":
+			z.ChecksumAlgorithm, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "checksum":
+			z.Checksum, bts, err = msgp.ReadBytesBytes(bts, z.Checksum)
+			if err != nil {
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -265,6 +309,6 @@ func (z *DiskCacheHeader) Msgsize() (s int) {
 			}
 		}
 	}
-	s += 15 + msgp.Int64Size
+	s += 15 + msgp.Int64Size + 19 + msgp.StringPrefixSize + len(z.ChecksumAlgorithm) + 9 + msgp.BytesPrefixSize + len(z.Checksum)
 	return
 }
@@ -0,0 +1,171 @@
+package response_cache
+
+import "os"
+import "sort"
+import "sync"
+import "time"
+
+// entries are tracked in memory so that we can evict the least recently used entries once the
+// cache grows past its size limit, without evicting anything that's still being streamed out.
+type cacheEntry struct {
+	size       int64
+	lastAccess time.Time
+	readers    int
+	complete   bool
+	indexed    time.Time // when the entry was last published to the index
+}
+
+type cacheIndex struct {
+	mutex     sync.Mutex
+	entries   map[string]*cacheEntry
+	totalSize int64
+}
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+func (index *cacheIndex) entryFor(path string) *cacheEntry {
+	entry := index.entries[path]
+	if entry == nil {
+		entry = &cacheEntry{}
+		index.entries[path] = entry
+	}
+	return entry
+}
+
+// acquire marks the entry as being read, so that it won't be evicted until the matching release.
+func (index *cacheIndex) acquire(path string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	entry := index.entryFor(path)
+	entry.readers += 1
+	entry.lastAccess = time.Now()
+}
+
+func (index *cacheIndex) release(path string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	entry := index.entries[path]
+	if entry == nil {
+		return
+	}
+	entry.readers -= 1
+
+	// if the fill that the readers were attached to never completed, there's nothing left to track
+	if entry.readers == 0 && !entry.complete {
+		delete(index.entries, path)
+	}
+}
+
+// published records a newly-completed entry, and returns the new total size of the cache.
+func (index *cacheIndex) published(path string, size int64, lastAccess time.Time) int64 {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	entry := index.entryFor(path)
+	if entry.complete {
+		index.totalSize -= entry.size
+	}
+	entry.size = size
+	entry.complete = true
+	entry.indexed = time.Now()
+	if lastAccess.After(entry.lastAccess) {
+		entry.lastAccess = lastAccess
+	}
+	index.totalSize += size
+	return index.totalSize
+}
+
+func (index *cacheIndex) reset() {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	for path, entry := range index.entries {
+		if entry.readers == 0 {
+			delete(index.entries, path)
+		} else {
+			entry.complete = false
+		}
+	}
+	index.totalSize = 0
+}
+
+// evict removes the least recently used completed entries that aren't being read until the
+// total size is no more than maxSize.
+func (index *cacheIndex) evict(maxSize int64, remove func(path string) error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.totalSize <= maxSize {
+		return
+	}
+
+	var candidates []string
+	for path, entry := range index.entries {
+		if entry.complete && entry.readers == 0 {
+			candidates = append(candidates, path)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return index.entries[candidates[i]].lastAccess.Before(index.entries[candidates[j]].lastAccess)
+	})
+
+	for _, path := range candidates {
+		if index.totalSize <= maxSize {
+			break
+		}
+		if err := remove(path); err != nil && !os.IsNotExist(err) {
+			logCacheError("Error evicting cache path %s: %s\n", path, err)
+			continue
+		}
+		index.totalSize -= index.entries[path].size
+		delete(index.entries, path)
+	}
+}
+
+// forget removes the given entry from the index, if nobody is reading it.
+func (index *cacheIndex) forget(path string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if entry := index.entries[path]; entry != nil && entry.readers == 0 {
+		if entry.complete {
+			index.totalSize -= entry.size
+		}
+		delete(index.entries, path)
+	}
+}
+
+// forgetAllExcept removes the completed entries that aren't in the given set from the index,
+// if nobody is reading them.  entries published since the given time are kept, since the set
+// won't include entries published after it was started.
+func (index *cacheIndex) forgetAllExcept(paths map[string]bool, since time.Time) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	for path, entry := range index.entries {
+		if entry.complete && entry.readers == 0 && !paths[path] && entry.indexed.Before(since) {
+			index.totalSize -= entry.size
+			delete(index.entries, path)
+		}
+	}
+}
+
+// cacheEntryFilename returns true if the filename is that of a published cache entry, rather than
+// a temporary file or a hidden file.
+func cacheEntryFilename(filename string) bool {
+	if filename == "" || filename[0] == '.' {
+		return false
+	}
+	for _, c := range filename {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package response_cache
+
+import "testing"
+
+import "bytes"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "time"
+
+func cacheEntry200(body string) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{},
+			ContentLength: int64(len(body)),
+			Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		}, nil
+	}
+}
+
+func getAndClose(t *testing.T, cache ResponseCache, key string, body string) {
+	res, err := cache.Get(key, cacheEntry200(body))
+	readAndClose(t, res, err)
+}
+
+func readAndClose(t *testing.T, res *http.Response, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+func assertCached(t *testing.T, path string, expected bool) {
+	_, err := os.Stat(path)
+	if expected && err != nil {
+		t.Errorf("expected %s to still be cached, but got %s", path, err)
+	} else if !expected && !os.IsNotExist(err) {
+		t.Errorf("expected %s to have been evicted", path)
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	cache.Clear()
+	dc := &diskCache{
+		cacheDirectory:   "test/cache",
+		progressTrackers: make(map[string]chan func() (*http.Response, error)),
+		index:            newCacheIndex(),
+		evictions:        make(chan struct{}, 1),
+	}
+
+	// populate three entries, then use the first again so that the second is the least recently used
+	getAndClose(t, dc, "aaaa", "first entry")
+	getAndClose(t, dc, "bbbb", "second entry")
+	getAndClose(t, dc, "cccc", "third entry")
+	for path := range dc.index.entries {
+		dc.index.entries[path].lastAccess = time.Now().Add(-time.Minute)
+	}
+	dc.index.entries["test/cache/bbbb"].lastAccess = time.Now().Add(-time.Hour)
+	getAndClose(t, dc, "aaaa", "first entry")
+
+	size := dc.index.totalSize
+	dc.index.evict(size-1, os.Remove)
+
+	assertCached(t, "test/cache/aaaa", true)
+	assertCached(t, "test/cache/bbbb", false)
+	assertCached(t, "test/cache/cccc", true)
+
+	if dc.index.totalSize >= size {
+		t.Errorf("expected the total size to drop below %d, was %d", size, dc.index.totalSize)
+	}
+}
+
+func TestDoesNotEvictEntriesBeingRead(t *testing.T) {
+	cache.Clear()
+	dc := &diskCache{
+		cacheDirectory:   "test/cache",
+		progressTrackers: make(map[string]chan func() (*http.Response, error)),
+		index:            newCacheIndex(),
+		evictions:        make(chan struct{}, 1),
+	}
+
+	getAndClose(t, dc, "aaaa", "first entry")
+	res, err := dc.Get("aaaa", cacheEntry200("first entry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc.index.evict(0, os.Remove)
+	assertCached(t, "test/cache/aaaa", true)
+
+	readAndClose(t, res, err)
+	dc.index.evict(0, os.Remove)
+	assertCached(t, "test/cache/aaaa", false)
+
+	if dc.index.totalSize != 0 {
+		t.Errorf("expected the total size to be 0, was %d", dc.index.totalSize)
+	}
+}
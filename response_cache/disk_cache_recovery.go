@@ -0,0 +1,157 @@
+package response_cache
+
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "strings"
+import "time"
+
+const quarantineDirectory = ".quarantine"
+
+// scan checks the cache directory for temporary files left behind by fills that never finished
+// (eg. because we were killed) and removes them, and for entries that are corrupt and moves them
+// out of the way so that we don't serve them again.  the entries that remain are added to the
+// index, which forgets any entries that have disappeared.
+func (cache *diskCache) scan() {
+	dir, err := os.Open(cache.cacheDirectory)
+	if err != nil {
+		logCacheError("Error scanning cache directory %s: %s\n", cache.cacheDirectory, err)
+		return
+	}
+	defer dir.Close()
+
+	started := time.Now()
+	found := make(map[string]bool)
+
+	for {
+		infos, err := dir.Readdir(1000)
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logCacheError("Error scanning cache directory %s: %s\n", cache.cacheDirectory, err)
+			return
+		}
+
+		for _, info := range infos {
+			path := cache.cacheDirectory + "/" + info.Name()
+
+			if strings.HasSuffix(info.Name(), ".temp") && info.Mode().IsRegular() {
+				cache.removeStaleTemporaryFile(path)
+			} else if strings.HasSuffix(info.Name(), ".lock") && info.Mode().IsRegular() {
+				cache.removeStaleLockFile(path)
+			} else if cacheEntryFilename(info.Name()) && info.Mode().IsRegular() {
+				if err := checkEntry(path, info.Size()); os.IsNotExist(err) {
+					// evicted or cleared since we listed the directory, so there's nothing to index
+				} else if err != nil {
+					cache.quarantine(path, err)
+				} else {
+					cache.index.published(path, info.Size(), info.ModTime())
+					found[path] = true
+				}
+			}
+		}
+	}
+
+	cache.index.forgetAllExcept(found, started)
+}
+
+// initialScan indexes the entries already in the cache directory when we start, which can take a
+// while for a large cache, and evicts entries if the cache has grown past its size limit.
+func (cache *diskCache) initialScan() {
+	cache.scan()
+	close(cache.scanned)
+	if cache.options.MaxSize > 0 {
+		cache.needsEviction()
+	}
+}
+
+func (cache *diskCache) scanPeriodically() {
+	for range time.Tick(cache.options.ScanInterval) {
+		cache.scan()
+		if cache.options.MaxSize > 0 {
+			cache.needsEviction()
+		}
+	}
+}
+
+func (cache *diskCache) fillInProgress(path string) bool {
+	cache.progressTrackersMutex.Lock()
+	defer cache.progressTrackersMutex.Unlock()
+	return cache.progressTrackers[path] != nil
+}
+
+// removeStaleTemporaryFile removes the temporary file unless it's being filled, either by us or by
+// another process sharing the cache directory.
+func (cache *diskCache) removeStaleTemporaryFile(tempPath string) {
+	path := entryPathForTemporaryFile(tempPath)
+	if cache.fillInProgress(path) {
+		return
+	}
+
+	// we take the lock ourselves so that no fill can start using the file while we remove it
+	lock, err := lockEntry(path)
+	if err != nil {
+		return
+	}
+	defer lock.release()
+
+	if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+		logCacheError("Error removing stale cache path %s: %s\n", tempPath, err)
+	}
+}
+
+// removeStaleLockFile removes lock files left behind by processes that died while filling.
+func (cache *diskCache) removeStaleLockFile(lockPath string) {
+	path := entryPathForTemporaryFile(lockPath)
+	if cache.fillInProgress(path) {
+		return
+	}
+
+	// if nobody holds the lock, taking and releasing it removes the file
+	if lock, err := lockEntry(path); err == nil {
+		lock.release()
+	}
+}
+
+// checkEntry returns an error if the cache entry's header can't be decoded, or if the body isn't
+// the length the header says it should be.  if the entry has been removed since we listed the
+// directory, the error satisfies os.IsNotExist.
+func checkEntry(path string, size int64) error {
+	file, err := osOpen(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	diskCacheHeader, headerLength, err := decodeHeader(file)
+	if err != nil {
+		return errors.New(fmt.Sprintf("couldn't decode header: %s", err))
+	}
+
+	if diskCacheHeader.ContentLength >= 0 && size-headerLength != diskCacheHeader.ContentLength {
+		return errors.New(fmt.Sprintf("response should have been %d bytes but was %d bytes", diskCacheHeader.ContentLength, size-headerLength))
+	}
+
+	return nil
+}
+
+// quarantine moves a corrupt cache entry into a hidden subdirectory, where it won't be served
+// again but can still be inspected.
+func (cache *diskCache) quarantine(path string, reason error) {
+	logCacheError("Quarantining corrupt cache path %s: %s\n", path, reason)
+
+	quarantinePath := cache.cacheDirectory + "/" + quarantineDirectory
+	if err := os.Mkdir(quarantinePath, 0755); err != nil && !os.IsExist(err) {
+		logCacheError("Error creating quarantine directory %s: %s\n", quarantinePath, err)
+		return
+	}
+
+	if err := os.Rename(path, quarantinePath+path[strings.LastIndex(path, "/"):]); err != nil && !os.IsNotExist(err) {
+		logCacheError("Error quarantining cache path %s: %s\n", path, err)
+		return
+	}
+
+	cache.index.forget(path)
+}
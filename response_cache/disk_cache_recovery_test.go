@@ -0,0 +1,126 @@
+package response_cache
+
+import "testing"
+
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "sort"
+
+func TestScanRecoversCacheDirectory(t *testing.T) {
+	cache.Clear()
+	os.RemoveAll("test/cache/" + quarantineDirectory)
+
+	originalLogCacheError := logCacheError
+	var errorLogs []string
+	logCacheError = func(format string, a ...interface{}) { errorLogs = append(errorLogs, fmt.Sprintf(format, a...)) }
+
+	// a good entry, a leftover temporary file, a truncated entry, and an entry with a corrupt header
+	getAndClose(t, cache, "aaaa", "some entry")
+	ioutil.WriteFile("test/cache/bbbb.temp", []byte("partial"), 0644)
+	getAndClose(t, cache, "cccc", "some other entry")
+	info, _ := os.Stat("test/cache/cccc")
+	os.Truncate("test/cache/cccc", info.Size()-1)
+	ioutil.WriteFile("test/cache/dddd", []byte{0xc1}, 0644)
+
+	dc := NewDiskCache("test/cache", DiskCacheOptions{}).(*diskCache)
+	<-dc.scanned
+
+	assertCached(t, "test/cache/aaaa", true)
+	assertCached(t, "test/cache/bbbb.temp", false)
+	assertCached(t, "test/cache/cccc", false)
+	assertCached(t, "test/cache/dddd", false)
+	assertCached(t, "test/cache/"+quarantineDirectory+"/cccc", true)
+	assertCached(t, "test/cache/"+quarantineDirectory+"/dddd", true)
+
+	info, _ = os.Stat("test/cache/aaaa")
+	if len(dc.index.entries) != 1 || dc.index.entries["test/cache/aaaa"] == nil {
+		t.Fatalf("expected only the good entry to be indexed, got %v", dc.index.entries)
+	}
+	if dc.index.totalSize != info.Size() {
+		t.Errorf("expected total size %d, got %d", info.Size(), dc.index.totalSize)
+	}
+
+	// the directory listing isn't in any particular order
+	sort.Strings(errorLogs)
+	if len(errorLogs) != 2 ||
+		errorLogs[0] != "Quarantining corrupt cache path test/cache/cccc: response should have been 16 bytes but was 15 bytes\n" ||
+		errorLogs[1][:55] != "Quarantining corrupt cache path test/cache/dddd: couldn" {
+		t.Errorf("unexpected error logs %v", errorLogs)
+	}
+
+	logCacheError = originalLogCacheError
+	os.RemoveAll("test/cache/" + quarantineDirectory)
+}
+
+func TestScanIndexesExistingEntries(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "abcd", "some entry")
+	ioutil.WriteFile("test/cache/abcd.temp", []byte("partial"), 0644)
+
+	dc := NewDiskCache("test/cache", DiskCacheOptions{}).(*diskCache)
+	<-dc.scanned
+
+	info, _ := os.Stat("test/cache/abcd")
+	if len(dc.index.entries) != 1 || dc.index.entries["test/cache/abcd"] == nil {
+		t.Fatalf("expected only the published entry to be indexed, got %v", dc.index.entries)
+	}
+	if dc.index.totalSize != info.Size() {
+		t.Errorf("expected total size %d, got %d", info.Size(), dc.index.totalSize)
+	}
+}
+
+func TestScanLeavesFillsInProgress(t *testing.T) {
+	cache.Clear()
+	ioutil.WriteFile("test/cache/bbbb.temp", []byte("partial"), 0644)
+
+	dc := cache.(*diskCache)
+	dc.progressTrackers["test/cache/bbbb"] = make(chan func() (*http.Response, error))
+	dc.scan()
+	delete(dc.progressTrackers, "test/cache/bbbb")
+
+	assertCached(t, "test/cache/bbbb.temp", true)
+}
+
+func TestScanKeepsEntriesPublishedDuringScan(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "some entry")
+
+	// publish another entry once the scan has listed the directory
+	dc := NewDiskCache("test/cache", DiskCacheOptions{}).(*diskCache)
+	<-dc.scanned
+	originalOsOpen := osOpen
+	osOpen = func(path string) (File, error) {
+		osOpen = originalOsOpen
+		getAndClose(t, dc, "bbbb", "some other entry")
+		return osOpen(path)
+	}
+	dc.scan()
+	osOpen = originalOsOpen
+
+	if len(dc.index.entries) != 2 || dc.index.entries["test/cache/aaaa"] == nil || dc.index.entries["test/cache/bbbb"] == nil {
+		t.Errorf("expected both entries to be indexed, got %v", dc.index.entries)
+	}
+}
+
+func TestScanDoesNotIndexEntriesRemovedDuringScan(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "some entry")
+
+	// remove the entry once the scan has listed the directory, as if it had been evicted
+	dc := NewDiskCache("test/cache", DiskCacheOptions{}).(*diskCache)
+	<-dc.scanned
+	dc.index.forget("test/cache/aaaa")
+	originalOsOpen := osOpen
+	osOpen = func(path string) (File, error) {
+		os.Remove(path)
+		return originalOsOpen(path)
+	}
+	dc.scan()
+	osOpen = originalOsOpen
+
+	if len(dc.index.entries) != 0 || dc.index.totalSize != 0 {
+		t.Errorf("expected the removed entry not to be indexed, got %v with total size %d", dc.index.entries, dc.index.totalSize)
+	}
+}
@@ -0,0 +1,98 @@
+package response_cache
+
+import "errors"
+import "io"
+import "os"
+import "sync"
+
+var errUnknownLength = errors.New("can't seek relative to the end of a response of unknown length")
+
+// entryReader reads from a cache entry file, which may still be being filled.
+type entryReader interface {
+	// readAt reads up to len(p) bytes from offset off, waiting until there is something there to
+	// read if the entry is still being filled.  it returns as soon as it has read anything.
+	readAt(p []byte, off int64) (int, error)
+
+	io.Closer
+}
+
+// completeEntry reads from a cache entry file that has been published, so has nothing to wait for.
+type completeEntry struct {
+	File
+}
+
+func (entry *completeEntry) readAt(p []byte, off int64) (int, error) {
+	n, err := entry.ReadAt(p, off)
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+// length returns the total length of the file, if it can be determined.
+func (entry *completeEntry) length() (int64, bool) {
+	if stater, ok := entry.File.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		if info, err := stater.Stat(); err == nil {
+			return info.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// entryHeaderReader reads sequentially from the start of a cache entry, so that we can decode its
+// header.
+type entryHeaderReader struct {
+	entryReader
+	position int64
+}
+
+func (reader *entryHeaderReader) Read(p []byte) (int, error) {
+	n, err := reader.readAt(p, reader.position)
+	reader.position += int64(n)
+	return n, err
+}
+
+// entryBody is the body of a response served from the cache.  it supports seeking, so that we can
+// serve ranges from it, even if the entry is still being filled.
+type entryBody struct {
+	reader   entryReader
+	start    int64 // offset of the body within the entry file
+	size     int64 // -1 if not known yet; only used to seek relative to the end
+	position int64
+	release  func()
+	once     sync.Once
+}
+
+func (body *entryBody) Read(p []byte) (int, error) {
+	n, err := body.reader.readAt(p, body.start+body.position)
+	body.position += int64(n)
+	return n, err
+}
+
+func (body *entryBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += body.position
+	case io.SeekEnd:
+		if body.size < 0 {
+			return body.position, errUnknownLength
+		}
+		offset += body.size
+	default:
+		return body.position, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return body.position, errors.New("negative position")
+	}
+	body.position = offset
+	return offset, nil
+}
+
+func (body *entryBody) Close() error {
+	err := body.reader.Close()
+	body.once.Do(body.release)
+	return err
+}
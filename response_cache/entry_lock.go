@@ -0,0 +1,119 @@
+package response_cache
+
+import "crypto/rand"
+import "encoding/hex"
+import "errors"
+import "io/ioutil"
+import "os"
+import "strings"
+import "syscall"
+
+var errEntryLocked = errors.New("cache entry is being filled by another process")
+
+// entryLock is an exclusive lock on filling a cache entry, held using flock on a lock file next to
+// the entry so that other processes sharing the same cache directory can see it.  the lock file
+// contains the path of the temporary file being filled, so that they can follow along.
+type entryLock struct {
+	file *os.File
+	path string
+}
+
+func lockPathFor(path string) string {
+	return path + ".lock"
+}
+
+// lockEntry takes the lock for the given cache entry path, or returns errEntryLocked if another
+// process (or another fill in this process) already holds it.
+func lockEntry(path string) (*entryLock, error) {
+	lockPath := lockPathFor(path)
+
+	for {
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, errEntryLocked
+			}
+			return nil, err
+		}
+
+		// the previous holder removes the lock file when it releases the lock, so if it did that after
+		// we opened the file but before we locked it, we've locked a file nobody else will look at and
+		// need to start again
+		if sameFileAsPath(file, lockPath) {
+			return &entryLock{file: file, path: lockPath}, nil
+		}
+		file.Close()
+	}
+}
+
+// setTempPath records the temporary file the entry is being filled in.
+func (lock *entryLock) setTempPath(tempPath string) error {
+	if err := lock.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := lock.file.WriteAt([]byte(tempPath), 0)
+	return err
+}
+
+func (lock *entryLock) release() {
+	// remove the file while we still hold the lock; see lockEntry
+	os.Remove(lock.path)
+	lock.file.Close()
+}
+
+// entryLocked returns true if some process currently holds the lock for the given entry path.
+func entryLocked(path string) bool {
+	file, err := os.Open(lockPathFor(path))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	// a shared lock conflicts with the filler's exclusive lock, but not with anyone else checking
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		return err == syscall.EWOULDBLOCK
+	}
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return false
+}
+
+// lockedTempPath returns the temporary file path recorded by the process holding the lock for the
+// given entry path, or "" if there isn't one yet.
+func lockedTempPath(path string) (string, error) {
+	data, err := ioutil.ReadFile(lockPathFor(path))
+	return string(data), err
+}
+
+// uniqueTempPath returns a temporary file path for filling the given entry path that won't clash
+// with any other process's; the entry path is everything up to the first ".".
+func uniqueTempPath(path string) string {
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	return path + "." + hex.EncodeToString(suffix[:]) + ".temp"
+}
+
+// entryPathForTemporaryFile returns the path of the entry a temporary or lock file belongs to.
+func entryPathForTemporaryFile(tempPath string) string {
+	directoryEnd := strings.LastIndex(tempPath, "/") + 1
+	if dot := strings.Index(tempPath[directoryEnd:], "."); dot >= 0 {
+		return tempPath[:directoryEnd+dot]
+	}
+	return tempPath
+}
+
+func sameFileAsPath(file *os.File, path string) bool {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fileInfo, pathInfo)
+}
@@ -0,0 +1,147 @@
+package response_cache
+
+import "testing"
+
+import "io/ioutil"
+import "net/http"
+import "os"
+import "time"
+
+// simulates another process starting to fill the entry, returning its lock and temporary file
+// with the header and the first part of the body written
+func startOtherProcessFill(t *testing.T, path string, body string, written int) (*entryLock, *os.File, string) {
+	lock, err := lockEntry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempPath := uniqueTempPath(path)
+	lock.setTempPath(tempPath)
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := cacheEntry200(body)()
+	(&diskCache{}).writeHeader(file, res, "")
+	file.Write([]byte(body[:written]))
+	return lock, file, tempPath
+}
+
+func getFromOtherProcessFill(t *testing.T, key string) (*http.Response, error) {
+	return cache.Get(key, func() (*http.Response, error) {
+		t.Error("request was forwarded when another process was already filling the entry")
+		return cacheEntry200("wrong")()
+	})
+}
+
+func waitForFollowerToFinish(path string) {
+	for cache.(*diskCache).fillInProgress(path) {
+		time.Sleep(tailPollInterval)
+	}
+}
+
+func TestLockEntryIsExclusive(t *testing.T) {
+	cache.Clear()
+	lock, err := lockEntry("test/cache/aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entryLocked("test/cache/aaaa") {
+		t.Error("expected the entry to be locked")
+	}
+	if _, err := lockEntry("test/cache/aaaa"); err != errEntryLocked {
+		t.Errorf("expected errEntryLocked, got %v", err)
+	}
+
+	lock.release()
+	assertCached(t, "test/cache/aaaa.lock", false)
+	if entryLocked("test/cache/aaaa") {
+		t.Error("expected the entry to be unlocked")
+	}
+
+	lock, err = lockEntry("test/cache/aaaa")
+	if err != nil {
+		t.Errorf("expected to be able to lock the entry again, got %s", err)
+	} else {
+		lock.release()
+	}
+}
+
+func TestFollowsFillByAnotherProcess(t *testing.T) {
+	cache.Clear()
+	originalTailPollInterval := tailPollInterval
+	tailPollInterval = 10 * time.Millisecond
+
+	body := "Test response body being filled by someone else."
+	lock, file, tempPath := startOtherProcessFill(t, "test/cache/aaaa", body, 10)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		file.Write([]byte(body[10:]))
+		file.Close()
+		os.Rename(tempPath, "test/cache/aaaa")
+		lock.release()
+	}()
+
+	res, err := getFromOtherProcessFill(t, "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Errorf("expected %q, got %q", body, data)
+	}
+
+	waitForFollowerToFinish("test/cache/aaaa")
+	tailPollInterval = originalTailPollInterval
+}
+
+func TestFollowsAbandonedFillByAnotherProcess(t *testing.T) {
+	cache.Clear()
+	originalTailPollInterval := tailPollInterval
+	tailPollInterval = 10 * time.Millisecond
+
+	lock, file, tempPath := startOtherProcessFill(t, "test/cache/aaaa", "Test response body.", 10)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		file.Close()
+		os.Remove(tempPath)
+		lock.release()
+	}()
+
+	res, err := getFromOtherProcessFill(t, "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != errFillAbandoned {
+		t.Errorf("expected errFillAbandoned, got %v", err)
+	}
+
+	waitForFollowerToFinish("test/cache/aaaa")
+	tailPollInterval = originalTailPollInterval
+}
+
+func TestScanRemovesFilesLeftByDeadProcesses(t *testing.T) {
+	cache.Clear()
+
+	// one fill still going in another process, and one whose process died
+	lock, file, liveTempPath := startOtherProcessFill(t, "test/cache/aaaa", "Test response body.", 10)
+	defer lock.release()
+	defer file.Close()
+	ioutil.WriteFile("test/cache/bbbb.lock", []byte("test/cache/bbbb.0123456789abcdef.temp"), 0644)
+	ioutil.WriteFile("test/cache/bbbb.0123456789abcdef.temp", []byte("partial"), 0644)
+
+	cache.(*diskCache).scan()
+
+	assertCached(t, liveTempPath, true)
+	assertCached(t, "test/cache/aaaa.lock", true)
+	assertCached(t, "test/cache/bbbb.0123456789abcdef.temp", false)
+	assertCached(t, "test/cache/bbbb.lock", false)
+}
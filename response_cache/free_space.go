@@ -0,0 +1,13 @@
+package response_cache
+
+import "syscall"
+
+// freeSpace returns the number of bytes and inodes available to unprivileged users on the
+// filesystem containing path.
+func freeSpace(path string) (freeBytes uint64, freeInodes uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Ffree), nil
+}
@@ -0,0 +1,138 @@
+package response_cache
+
+import "compress/gzip"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+
+var errInvalidPktLine = errors.New("invalid git pkt-line")
+
+// CacheableGitUploadPack returns true if the git upload-pack request asks for a pack of specific
+// objects, so that the response will always be the same.  for protocol v2, that means fetch
+// commands that want objects by ID; other commands like ls-refs list the current refs, so their
+// responses change, and fetch commands that want refs by name depend on where the refs point.
+func CacheableGitUploadPack(req *http.Request) bool {
+	lines, err := gitUploadPackLines(req)
+	if err != nil {
+		return false
+	}
+
+	if strings.Contains(req.Header.Get("Git-Protocol"), "version=2") {
+		if len(lines) == 0 || lines[0] != "command=fetch" {
+			return false
+		}
+	}
+
+	wants := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "want-ref ") {
+			return false
+		}
+		if strings.HasPrefix(line, "want ") {
+			wants = true
+		}
+	}
+	return wants
+}
+
+// GitUploadPackKey returns a cache key for the git upload-pack request that is the same for any
+// client asking for the same objects, regardless of their git version or the order they listed
+// things in.  the key is made from the request line, the headers that affect the response, and
+// the set of lines and capabilities in the body, excluding those that only identify the client.
+func GitUploadPackKey(req *http.Request) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "%s %s\x00", req.Method, req.URL)
+	for _, name := range []string{"Git-Protocol", "Accept-Encoding"} {
+		fmt.Fprintf(&key, "%s: %s\x00", name, strings.Join(req.Header[name], ","))
+	}
+
+	lines, err := gitUploadPackLines(req)
+	if err != nil {
+		// we don't understand it, so use the body as it is
+		if body, err := spooledRequestBody(req); err == nil {
+			io.Copy(&key, body.newReader())
+		}
+		return HashString(key.String())
+	}
+
+	var items []string
+	for _, line := range lines {
+		// the first want line in protocol v0/v1 also lists the client's capabilities
+		fields := []string{line}
+		if strings.HasPrefix(line, "want ") {
+			if fields = strings.Fields(line); len(fields) >= 2 {
+				fields = append([]string{"want " + fields[1]}, fields[2:]...)
+			}
+		}
+
+		for _, item := range fields {
+			if item != "" && !strings.HasPrefix(item, "agent=") && !strings.HasPrefix(item, "session-id=") {
+				items = append(items, item)
+			}
+		}
+	}
+
+	sort.Strings(items)
+	for index, item := range items {
+		if index == 0 || item != items[index-1] {
+			key.WriteString(item)
+			key.WriteByte(0)
+		}
+	}
+	return HashString(key.String())
+}
+
+// gitUploadPackLines returns the lines of the git upload-pack request body.  compressed bodies
+// are held to the same size limit once decompressed.
+func gitUploadPackLines(req *http.Request) ([]string, error) {
+	body, err := spooledRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("Content-Encoding") != "gzip" {
+		return readPktLines(body.newReader())
+	}
+
+	gunzipped, err := gzip.NewReader(body.newReader())
+	if err != nil {
+		return nil, err
+	}
+	defer gunzipped.Close()
+	limited := &io.LimitedReader{R: gunzipped, N: body.limit + 1}
+	lines, err := readPktLines(limited)
+	if limited.N == 0 {
+		return nil, errRequestBodyTooLarge
+	}
+	return lines, err
+}
+
+// readPktLines splits a git pkt-line stream into its lines; the special flush, delimiter, and
+// response-end packets are returned as empty lines.
+func readPktLines(r io.Reader) ([]string, error) {
+	var lines []string
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(r, length[:]); err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return nil, errInvalidPktLine
+		}
+		n, err := strconv.ParseUint(string(length[:]), 16, 16)
+		if err != nil {
+			return nil, errInvalidPktLine
+		}
+		if n < 4 {
+			lines = append(lines, "")
+			continue
+		}
+		line := make([]byte, n-4)
+		if _, err := io.ReadFull(r, line); err != nil {
+			return nil, errInvalidPktLine
+		}
+		lines = append(lines, strings.TrimSuffix(string(line), "\n"))
+	}
+}
@@ -0,0 +1,132 @@
+package response_cache
+
+import "testing"
+
+import "bytes"
+import "compress/gzip"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "strings"
+
+func pktLines(lines ...string) string {
+	var result strings.Builder
+	for _, line := range lines {
+		switch line {
+		case "0000", "0001":
+			result.WriteString(line)
+		default:
+			fmt.Fprintf(&result, "%04x%s\n", len(line)+5, line)
+		}
+	}
+	return result.String()
+}
+
+func uploadPackRequest(protocol string, body string) *http.Request {
+	req, _ := http.NewRequest("POST", "https://github.com/willbryant/proximate.git/git-upload-pack", strings.NewReader(body))
+	if protocol != "" {
+		req.Header.Set("Git-Protocol", protocol)
+	}
+	return req
+}
+
+func assertCacheableGitUploadPack(t *testing.T, req *http.Request, expected bool) {
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if CacheableGitUploadPack(req) != expected {
+		t.Errorf("expected CacheableGitUploadPack to be %v for %q", expected, body)
+	}
+
+	// and the body should still be there to send upstream
+	if after, _ := ioutil.ReadAll(req.Body); !bytes.Equal(body, after) {
+		t.Errorf("expected the body to be kept, got %q", after)
+	}
+}
+
+func TestCacheableGitUploadPackV0(t *testing.T) {
+	want := "want 0123456789012345678901234567890123456789 multi_ack_detailed side-band-64k"
+	have := "have 9876543210987654321098765432109876543210"
+	assertCacheableGitUploadPack(t, uploadPackRequest("", pktLines(want, "0000", have, "done")), true)
+	assertCacheableGitUploadPack(t, uploadPackRequest("", pktLines("0000")), false)
+	assertCacheableGitUploadPack(t, uploadPackRequest("", "not a pkt-line"), false)
+}
+
+func TestCacheableGitUploadPackV2(t *testing.T) {
+	want := "want 0123456789012345678901234567890123456789"
+	assertCacheableGitUploadPack(t, uploadPackRequest("version=2", pktLines("command=fetch", "agent=git/2.39.2", "0001", "thin-pack", want, "done", "0000")), true)
+	assertCacheableGitUploadPack(t, uploadPackRequest("version=2", pktLines("command=ls-refs", "agent=git/2.39.2", "0001", "peel", "ref-prefix refs/heads/", "0000")), false)
+	assertCacheableGitUploadPack(t, uploadPackRequest("version=2", pktLines("command=fetch", "0001", "want-ref refs/heads/master", "done", "0000")), false)
+}
+
+func TestCacheableGitUploadPackGzipped(t *testing.T) {
+	var body bytes.Buffer
+	writer := gzip.NewWriter(&body)
+	writer.Write([]byte(pktLines("command=fetch", "0001", "want 0123456789012345678901234567890123456789", "done", "0000")))
+	writer.Close()
+
+	req := uploadPackRequest("version=2", body.String())
+	req.Header.Set("Content-Encoding", "gzip")
+	assertCacheableGitUploadPack(t, req, true)
+}
+
+func TestCacheableGitUploadPackGzippedSizeLimit(t *testing.T) {
+	want := pktLines("want 0123456789012345678901234567890123456789")
+	wants := strings.Repeat(want, DefaultMaxRequestBodySize/len(want)+1)
+
+	// compresses to well under the limit, but is over it once decompressed
+	var body bytes.Buffer
+	writer := gzip.NewWriter(&body)
+	writer.Write([]byte(pktLines("command=fetch", "0001") + wants))
+	writer.Close()
+
+	req := uploadPackRequest("version=2", body.String())
+	req.Header.Set("Content-Encoding", "gzip")
+	if _, err := spoolRequestBody(req, DefaultMaxRequestBodySize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitUploadPackLines(req); err != errRequestBodyTooLarge {
+		t.Errorf("expected the decompressed body to be too large, got %v", err)
+	}
+}
+
+func TestGitUploadPackKeyIgnoresClientDifferences(t *testing.T) {
+	want1 := "want 0123456789012345678901234567890123456789"
+	want2 := "want 1123456789012345678901234567890123456789"
+	have1 := "have 9876543210987654321098765432109876543210"
+	have2 := "have 8876543210987654321098765432109876543210"
+
+	key := GitUploadPackKey(uploadPackRequest("version=2", pktLines("command=fetch", "agent=git/2.39.2", "session-id=abc", "0001", "thin-pack", "ofs-delta", want1, want2, have1, have2, "done", "0000")))
+	same := []*http.Request{
+		uploadPackRequest("version=2", pktLines("command=fetch", "agent=git/2.43.0", "0001", "ofs-delta", "thin-pack", want2, want1, have2, have1, "done", "0000")),
+		uploadPackRequest("version=2", pktLines("command=fetch", "session-id=def", "0001", "thin-pack", "ofs-delta", want1, want2, have1, have2, "done", "0000")),
+	}
+	different := []*http.Request{
+		uploadPackRequest("version=2", pktLines("command=fetch", "0001", "thin-pack", "ofs-delta", want1, have1, have2, "done", "0000")),
+		uploadPackRequest("version=2", pktLines("command=fetch", "0001", "thin-pack", want1, want2, have1, have2, "done", "0000")),
+		uploadPackRequest("version=2", pktLines("command=fetch", "0001", "thin-pack", "ofs-delta", want1, want2, have1, "done", "0000")),
+		uploadPackRequest("", pktLines("command=fetch", "0001", "thin-pack", "ofs-delta", want1, want2, have1, have2, "done", "0000")),
+	}
+
+	for _, req := range same {
+		if GitUploadPackKey(req) != key {
+			t.Errorf("expected the same key for %v", req.Header)
+		}
+	}
+	for index, req := range different {
+		if GitUploadPackKey(req) == key {
+			t.Errorf("expected a different key for request %d", index)
+		}
+	}
+}
+
+func TestGitUploadPackKeyV0Capabilities(t *testing.T) {
+	want := "want 0123456789012345678901234567890123456789"
+	have := "have 9876543210987654321098765432109876543210"
+	key := GitUploadPackKey(uploadPackRequest("", pktLines(want+" multi_ack_detailed side-band-64k agent=git/2.39.2", "0000", have, "done")))
+	if GitUploadPackKey(uploadPackRequest("", pktLines(want+" side-band-64k multi_ack_detailed agent=git/2.20.1", "0000", have, "done"))) != key {
+		t.Error("expected the capability order and agent not to change the key")
+	}
+	if GitUploadPackKey(uploadPackRequest("", pktLines(want+" side-band multi_ack_detailed", "0000", have, "done"))) == key {
+		t.Error("expected different capabilities to change the key")
+	}
+}
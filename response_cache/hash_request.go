@@ -1,14 +1,30 @@
 package response_cache
 
-import "bytes"
 import "io"
-import "io/ioutil"
 import "crypto/sha256"
 import "encoding/hex"
 import "net/http"
+import "net/url"
 import "sort"
 
-func digestRequestAndBody(req *http.Request) ([]byte, error) {
+// keyVersion is put at the start of keys made by HashRequest, so that they never clash with keys
+// made by HashRequestAndBody, which hashes the request differently.
+const keyVersion = "01"
+
+// KeyOptions says which parts of the request go in its cache key.
+type KeyOptions struct {
+	// the request headers to include; nil means all of them
+	Headers []string
+
+	// include the HTTP version of the request
+	IncludeProto bool
+
+	// query parameters to leave out of the URL
+	IgnoreQuery []string
+}
+
+// digestRequestAndBody hashes the request, including the parts given by the options.
+func digestRequestAndBody(req *http.Request, options KeyOptions) ([]byte, error) {
 	terminator := [...]byte{0}
 	hasher := sha256.New()
 
@@ -21,25 +37,35 @@ func digestRequestAndBody(req *http.Request) ([]byte, error) {
 	}
 
 	// hash the URL
-	if _, err := io.WriteString(hasher, req.URL.String()); err != nil {
+	if _, err := io.WriteString(hasher, keyURL(req.URL, options.IgnoreQuery)); err != nil {
 		return nil, err
 	}
 	if _, err := hasher.Write(terminator[:]); err != nil {
 		return nil, err
 	}
 
-	// hash the URL
-	if _, err := io.WriteString(hasher, req.Proto); err != nil {
-		return nil, err
-	}
-	if _, err := hasher.Write(terminator[:]); err != nil {
-		return nil, err
+	// hash the protocol version
+	if options.IncludeProto {
+		if _, err := io.WriteString(hasher, req.Proto); err != nil {
+			return nil, err
+		}
+		if _, err := hasher.Write(terminator[:]); err != nil {
+			return nil, err
+		}
 	}
 
 	// hash the request headers; explicitly sort the headers by name as maps have unordered iteration
 	var keys []string
-	for k := range req.Header {
-		keys = append(keys, k)
+	if options.Headers == nil {
+		for k := range req.Header {
+			keys = append(keys, k)
+		}
+	} else {
+		for _, k := range options.Headers {
+			if _, ok := req.Header[http.CanonicalHeaderKey(k)]; ok {
+				keys = append(keys, http.CanonicalHeaderKey(k))
+			}
+		}
 	}
 	sort.Strings(keys)
 	for _, k := range keys {
@@ -67,17 +93,13 @@ func digestRequestAndBody(req *http.Request) ([]byte, error) {
 		}
 	}
 
-	// read the request body, and substitute our copy for the original reader since we can't rewind that
-	body := make([]byte, req.ContentLength)
-	if _, err := io.ReadFull(req.Body, body); err != nil {
+	// hash the request body; we have to keep a copy to send upstream, but it may be too big to
+	// keep in memory
+	body, err := spooledRequestBody(req)
+	if err != nil {
 		return nil, err
 	}
-
-	req.Body.Close()
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
-
-	// hash the request body
-	if _, err := hasher.Write(body); err != nil {
+	if _, err := io.Copy(hasher, body.newReader()); err != nil {
 		return nil, err
 	}
 	if _, err := hasher.Write(terminator[:]); err != nil {
@@ -87,14 +109,47 @@ func digestRequestAndBody(req *http.Request) ([]byte, error) {
 	return hasher.Sum(nil), nil
 }
 
+// keyURL returns the URL to put in the cache key, without the ignored query parameters.
+func keyURL(u *url.URL, ignoreQuery []string) string {
+	if len(ignoreQuery) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+	query := u.Query()
+	for _, name := range ignoreQuery {
+		query.Del(name)
+	}
+	withoutIgnored := *u
+	withoutIgnored.RawQuery = query.Encode()
+	return withoutIgnored.String()
+}
+
 func digestToHash(digest []byte) string {
 	return hex.EncodeToString(digest)
 }
 
+// HashRequestAndBody returns the cache key used for all requests before key options were added.
+// it includes the protocol version and all the headers.
 func HashRequestAndBody(req *http.Request) (string, error) {
-	digest, err := digestRequestAndBody(req)
+	digest, err := digestRequestAndBody(req, KeyOptions{IncludeProto: true})
 	if err != nil {
 		return "", err
 	}
 	return digestToHash(digest), nil
 }
+
+// HashRequest returns the cache key for the request, including only the parts of the request
+// given by the options.
+func HashRequest(req *http.Request, options KeyOptions) (string, error) {
+	digest, err := digestRequestAndBody(req, options)
+	if err != nil {
+		return "", err
+	}
+	return keyVersion + digestToHash(digest), nil
+}
+
+// HashString returns a cache key for the given string, for responses that are identified by
+// something other than the request.
+func HashString(str string) string {
+	digest := sha256.Sum256([]byte(str))
+	return digestToHash(digest[:])
+}
@@ -2,12 +2,51 @@ package response_cache
 
 import "errors"
 import "net/http"
+import "time"
 
 var Uncacheable = errors.New("Uncacheable")
 
+// LowDiskSpace is returned along with the response when it couldn't be cached because the cache
+// filesystem is low on space, and by Health while that's the case.
+var LowDiskSpace = errors.New("cache bypassed, low disk space")
+
+// ServedStale is returned along with an expired response that is being served because fetching it
+// again failed.
+var ServedStale = errors.New("expired response served, couldn't refresh")
+
+// Aliased is returned by fetch functions instead of a response when they've used Alias to make an
+// existing entry available under the key being fetched, so that the cache serves that entry.
+var Aliased = errors.New("entry aliased from another key")
+var errNotModified = errors.New("cached response not modified")
+var errRefreshFailed = errors.New("another request couldn't refresh it")
+
 type ResponseCache interface {
 	Clear() error
 	Get(key string, miss func() (*http.Response, error)) (*http.Response, error)
+
+	// GetFresh is like Get, but if the cached response was stored more than maxAge ago, it is
+	// fetched again; 0 means cached responses never expire.
+	GetFresh(key string, maxAge time.Duration, miss func() (*http.Response, error)) (*http.Response, error)
+
+	// GetRevalidated is like GetFresh, but once the cached response has expired, the fetch
+	// function is given conditional request headers made from its ETag and Last-Modified headers.
+	// if it returns a 304 response, the cached response is kept for another maxAge.  if the fetch
+	// fails and the cache serves stale responses on error, the expired response is returned
+	// along with ServedStale.
+	GetRevalidated(key string, maxAge time.Duration, fetch func(validators http.Header) (*http.Response, error)) (*http.Response, error)
+
+	// Lookup returns the cached response for the key without fetching it if it's not cached or
+	// was stored more than maxAge ago, in which case the error satisfies os.IsNotExist.
+	Lookup(key string, maxAge time.Duration) (*http.Response, error)
+
+	// Alias makes the entry for oldKey, if there is one, also available under newKey, unless
+	// there's already an entry for newKey, and returns true if it did.  this lets us keep using
+	// entries stored under an old key format.
+	Alias(oldKey string, newKey string) (bool, error)
+
+	// Health returns an error describing any condition that is currently stopping new responses
+	// from being cached, or nil if there is none.
+	Health() error
 }
 
 func CacheableResponse(status int, header http.Header) bool {
@@ -2,16 +2,32 @@ package response_cache
 
 import "testing"
 import "bytes"
+import "errors"
 import "io"
+import "io/ioutil"
 import "fmt"
 import "math/rand"
 import "net/http"
 import "os"
 import "reflect"
+import "regexp"
 import "strconv"
 import "syscall"
+import "time"
 
-var cache ResponseCache = NewDiskCache("test/cache")
+var cache ResponseCache
+
+// the tests share the test/cache directory, which we create if this is a fresh checkout
+func TestMain(m *testing.M) {
+	if err := os.MkdirAll("test/cache", 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't create test cache directory: %s\n", err)
+		os.Exit(1)
+	}
+	cache = NewDiskCache("test/cache", DiskCacheOptions{})
+	os.Exit(m.Run())
+}
+
+var uniqueTempSuffix = regexp.MustCompile(`\.[0-9a-f]{16}\.temp`)
 
 type multiByteReader struct {
 	data      [][]byte
@@ -87,7 +103,10 @@ func testScenario(t *testing.T, scenario scenarioData) {
 
 	originalLogCacheError := logCacheError
 	var errorLogs []string
-	logCacheError = func(format string, a ...interface{}) { errorLogs = append(errorLogs, fmt.Sprintf(format, a...)) }
+	logCacheError = func(format string, a ...interface{}) {
+		// temporary file names are unique, so normalize them to keep the expected logs readable
+		errorLogs = append(errorLogs, uniqueTempSuffix.ReplaceAllString(fmt.Sprintf(format, a...), ".temp"))
+	}
 
 	// write the scenario to the cache adapter
 	forwarded := false
@@ -98,8 +117,8 @@ func testScenario(t *testing.T, scenario scenarioData) {
 	if !forwarded {
 		t.Fatal("request callback wasn't forwarded")
 	}
-	if err != nil && err != Uncacheable {
-		t.Fatal(fmt.Sprintf("result wasn't nil or Uncacheable, was %s", err))
+	if err != nil && err != Uncacheable && err != scenario.ExpectedError {
+		t.Fatal(fmt.Sprintf("result wasn't nil, Uncacheable, or the expected error, was %s", err))
 	}
 
 	// check it was all forwarded through to the HTTP response object
@@ -311,6 +330,75 @@ func TestFileOpenFailure(t *testing.T) {
 	osOpen = originalOsOpen
 }
 
+func TestLowDiskSpace(t *testing.T) {
+	originalCache := cache
+	originalStatFilesystem := statFilesystem
+	cache = NewDiskCache("test/cache", DiskCacheOptions{MinFreeBytes: 1024 * 1024, MinFreeInodes: 100})
+	statFilesystem = func(path string) (uint64, uint64, error) { return 1024, 1000, nil }
+	testScenario(t, scenarioData{
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type":   []string{"text/html"},
+			"X-Served-By":    []string{"test case"},
+			"Content-Length": []string{"19"},
+		},
+		Data: [][]byte{
+			[]byte("Test response body."),
+		},
+		ShouldCache: false,
+
+		// the response should be proxied through, with an error to say that it wasn't cached, and
+		// the condition only logged once
+		ExpectedError: LowDiskSpace,
+		ExpectedErrorLogs: []string{
+			"Cache directory test/cache is low on space (1024 bytes, 1000 inodes free), bypassing cache\n",
+		},
+	})
+	if cache.Health() != LowDiskSpace {
+		t.Error("expected the cache health to report low disk space")
+	}
+
+	statFilesystem = func(path string) (uint64, uint64, error) { return 1024 * 1024 * 1024, 1000, nil }
+	testScenario(t, scenarioData{
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type":   []string{"text/html"},
+			"X-Served-By":    []string{"test case"},
+			"Content-Length": []string{"19"},
+		},
+		Data: [][]byte{
+			[]byte("Test response body."),
+		},
+		ShouldCache: true,
+		ExpectedErrorLogs: []string{
+			"Cache directory test/cache has space again (1073741824 bytes, 1000 inodes free), resuming caching\n",
+		},
+	})
+	if cache.Health() != nil {
+		t.Error("expected the cache health to have recovered")
+	}
+
+	// the health check looks at the free space itself, without waiting for a request to notice
+	originalLogCacheError := logCacheError
+	var errorLogs []string
+	logCacheError = func(format string, a ...interface{}) { errorLogs = append(errorLogs, fmt.Sprintf(format, a...)) }
+	statFilesystem = func(path string) (uint64, uint64, error) { return 1024 * 1024 * 1024, 10, nil }
+	if cache.Health() != LowDiskSpace {
+		t.Error("expected the cache health to report low disk space without a request")
+	}
+	statFilesystem = func(path string) (uint64, uint64, error) { return 1024 * 1024 * 1024, 1000, nil }
+	if cache.Health() != nil {
+		t.Error("expected the cache health to recover without a request")
+	}
+	if len(errorLogs) != 2 {
+		t.Errorf("expected the changes to be logged, got %v", errorLogs)
+	}
+	logCacheError = originalLogCacheError
+
+	statFilesystem = originalStatFilesystem
+	cache = originalCache
+}
+
 type SizeLimitedFile struct {
 	path string
 	file File
@@ -340,6 +428,10 @@ func (f *SizeLimitedFile) ReadAt(p []byte, off int64) (int, error) {
 	return f.file.ReadAt(p, off)
 }
 
+func (f *SizeLimitedFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.file.WriteAt(p, off)
+}
+
 func (f *SizeLimitedFile) Sync() error {
 	return f.file.Sync()
 }
@@ -348,6 +440,40 @@ func (f *SizeLimitedFile) Close() error {
 	return f.file.Close()
 }
 
+func TestSharedFileWriteFailureFailsReaders(t *testing.T) {
+	file, err := os.Create("test/cache/shared.temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test/cache/shared.temp")
+
+	sf := NewSharedFile(&SizeLimitedFile{"test/cache/shared.temp", file, 4, 0})
+	reader, err := sf.SpawnReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sf.Write([]byte("too long")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	// without the error, the reader would wait forever for the rest of the file
+	done := make(chan struct{})
+	go func() {
+		data, err := ioutil.ReadAll(reader)
+		if string(data) != "too " || !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("expected the readers to get the write error after the data written, got %q and %v", data, err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the readers to get the write error, but they are still waiting")
+	}
+	reader.Close()
+	sf.Release()
+}
+
 func TestFileWriteFirstFailure(t *testing.T) {
 	originalOsCreate := osCreate
 	maxSize := 0
@@ -0,0 +1,157 @@
+package response_cache
+
+import "context"
+import "fmt"
+import "io"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+
+// ResumeInterruptedBody wraps the body of the response so that if the upstream connection drops
+// partway through, the rest of the body is fetched with a ranged request and read on from there,
+// up to retries times.  resume is called with the Range and If-Range headers to add to a copy of
+// the original request.  once the body has been closed or the context is done, we don't resume.
+//
+// this can only be done safely if upstream says it supports ranges and gives us a validator to
+// make sure we get the rest of the same response; if not, the response is returned unchanged.
+func ResumeInterruptedBody(ctx context.Context, res *http.Response, retries int, resume func(rangeHeaders http.Header) (*http.Response, error)) *http.Response {
+	if retries <= 0 || res.StatusCode != http.StatusOK || !acceptsByteRanges(res.Header) {
+		return res
+	}
+
+	// weak entity tags can't be used with If-Range
+	validator := res.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = res.Header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return res
+	}
+
+	res.Body = &resumingBody{
+		ctx:           ctx,
+		body:          res.Body,
+		contentLength: res.ContentLength,
+		validator:     validator,
+		retriesLeft:   retries,
+		resume:        resume,
+	}
+	return res
+}
+
+func acceptsByteRanges(header http.Header) bool {
+	for _, value := range header["Accept-Ranges"] {
+		for _, unit := range strings.Split(value, ",") {
+			if strings.TrimSpace(unit) == "bytes" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type resumingBody struct {
+	ctx           context.Context
+	mutex         sync.Mutex // held while replacing or closing body
+	closed        bool
+	body          io.ReadCloser
+	offset        int64
+	contentLength int64
+	validator     string
+	retriesLeft   int
+	resume        func(rangeHeaders http.Header) (*http.Response, error)
+}
+
+func (body *resumingBody) Read(p []byte) (int, error) {
+	for {
+		n, err := body.body.Read(p)
+		body.offset += int64(n)
+		if err == nil || err == io.EOF || body.retriesLeft <= 0 || !body.resumable() {
+			return n, err
+		}
+
+		// the connection failed; if we can't pick up where it left off, return the original error
+		body.retriesLeft -= 1
+		if !body.resumeFromOffset() {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resumable returns false if the body has been closed, which is how the cache abandons fills, or
+// the context is done; reads failing because of that aren't interruptions to recover from.
+func (body *resumingBody) resumable() bool {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	return !body.closed && body.ctx.Err() == nil
+}
+
+func (body *resumingBody) resumeFromOffset() bool {
+	rangeHeaders := http.Header{
+		"Range":    []string{fmt.Sprintf("bytes=%d-", body.offset)},
+		"If-Range": []string{body.validator},
+	}
+	res, err := body.resume(rangeHeaders)
+	if err != nil {
+		return false
+	}
+
+	// if the response has changed upstream, we'll get the full response back instead; we can't
+	// use that, since readers have already been sent the start of the old response
+	if res.StatusCode != http.StatusPartialContent || !body.matchingContentRange(res.Header.Get("Content-Range")) {
+		res.Body.Close()
+		return false
+	}
+
+	// we may have been closed while we were waiting for the response
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	if body.closed {
+		res.Body.Close()
+		return false
+	}
+	body.body.Close()
+	body.body = res.Body
+	return true
+}
+
+// matchingContentRange returns true if the Content-Range continues the response from our offset.
+func (body *resumingBody) matchingContentRange(contentRange string) bool {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return false
+	}
+	parts := strings.SplitN(contentRange[6:], "/", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return false
+	}
+
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || first != body.offset {
+		return false
+	}
+	if body.contentLength >= 0 {
+		last, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || last != body.contentLength-1 {
+			return false
+		}
+		if parts[1] != "*" && parts[1] != strconv.FormatInt(body.contentLength, 10) {
+			return false
+		}
+	}
+	return true
+}
+
+func (body *resumingBody) Close() error {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	body.closed = true
+	return body.body.Close()
+}
@@ -0,0 +1,177 @@
+package response_cache
+
+import "testing"
+
+import "bytes"
+import "context"
+import "errors"
+import "io"
+import "io/ioutil"
+import "net/http"
+
+var errConnectionDropped = errors.New("connection dropped")
+
+// failingReader returns the data, then an error instead of EOF
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errConnectionDropped
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func resumableResponse(body string, sent int) *http.Response {
+	return &http.Response{
+		StatusCode: 200,
+		Header: http.Header{
+			"Accept-Ranges": []string{"bytes"},
+			"Etag":          []string{`"v1"`},
+		},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(&failingReader{[]byte(body[:sent])}),
+	}
+}
+
+func partialResponse(body string, from int, sent int, contentRange string) *http.Response {
+	return &http.Response{
+		StatusCode:    206,
+		Header:        http.Header{"Content-Range": []string{contentRange}},
+		ContentLength: int64(len(body) - from),
+		Body:          ioutil.NopCloser(io.MultiReader(bytes.NewReader([]byte(body[from:sent])), &failingReader{})),
+	}
+}
+
+func TestResumesInterruptedBody(t *testing.T) {
+	body := "Test response body that gets interrupted."
+	var requested []http.Header
+	res := ResumeInterruptedBody(context.Background(), resumableResponse(body, 10), 3, func(rangeHeaders http.Header) (*http.Response, error) {
+		requested = append(requested, rangeHeaders)
+		if len(requested) == 1 {
+			return partialResponse(body, 10, 20, "bytes 10-40/41"), nil
+		}
+		return partialResponse(body, 20, len(body), "bytes 20-40/41"), nil
+	})
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != errConnectionDropped || string(data) != body {
+		t.Errorf("expected the full body then the final error, got %q %v", data, err)
+	}
+	if len(requested) != 3 {
+		t.Fatalf("expected 3 attempts to resume, got %d", len(requested))
+	}
+	if requested[0].Get("Range") != "bytes=10-" || requested[1].Get("Range") != "bytes=20-" || requested[0].Get("If-Range") != `"v1"` {
+		t.Errorf("expected ranged requests from the interrupted offsets, got %v", requested)
+	}
+}
+
+func TestResumeGivesUpAfterRetries(t *testing.T) {
+	body := "Test response body that gets interrupted."
+	attempts := 0
+	res := ResumeInterruptedBody(context.Background(), resumableResponse(body, 10), 2, func(rangeHeaders http.Header) (*http.Response, error) {
+		attempts++
+		return partialResponse(body, 10, 10, "bytes 10-40/41"), nil
+	})
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != errConnectionDropped || string(data) != body[:10] {
+		t.Errorf("expected the error after the first part of the body, got %q %v", data, err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts to resume, got %d", attempts)
+	}
+}
+
+func TestResumeRejectsChangedResponses(t *testing.T) {
+	body := "Test response body that gets interrupted."
+	res := ResumeInterruptedBody(context.Background(), resumableResponse(body, 10), 3, func(rangeHeaders http.Header) (*http.Response, error) {
+		// the If-Range didn't match, so we got the whole new response
+		return cacheEntry200("Some other response body entirely.")()
+	})
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != errConnectionDropped || string(data) != body[:10] {
+		t.Errorf("expected the original error, got %q %v", data, err)
+	}
+
+	res = ResumeInterruptedBody(context.Background(), resumableResponse(body, 10), 1, func(rangeHeaders http.Header) (*http.Response, error) {
+		return partialResponse(body, 0, len(body), "bytes 0-40/41"), nil
+	})
+	data, err = ioutil.ReadAll(res.Body)
+	if err != errConnectionDropped || string(data) != body[:10] {
+		t.Errorf("expected the original error for the wrong range, got %q %v", data, err)
+	}
+}
+
+func TestResumeStopsOnceClosedOrCancelled(t *testing.T) {
+	body := "Test response body that gets interrupted."
+	resume := func(rangeHeaders http.Header) (*http.Response, error) {
+		t.Error("tried to resume a response that had been given up on")
+		return partialResponse(body, 10, len(body), "bytes 10-40/41"), nil
+	}
+
+	// the cache closes the body to abandon the fill, which makes the read fail
+	res := ResumeInterruptedBody(context.Background(), resumableResponse(body, 10), 3, resume)
+	res.Body.Close()
+	if data, err := ioutil.ReadAll(res.Body); err != errConnectionDropped || string(data) != body[:10] {
+		t.Errorf("expected the original error once closed, got %q %v", data, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res = ResumeInterruptedBody(ctx, resumableResponse(body, 10), 3, resume)
+	cancel()
+	if data, err := ioutil.ReadAll(res.Body); err != errConnectionDropped || string(data) != body[:10] {
+		t.Errorf("expected the original error once cancelled, got %q %v", data, err)
+	}
+}
+
+func TestResumeRequiresRangesAndValidator(t *testing.T) {
+	resume := func(rangeHeaders http.Header) (*http.Response, error) {
+		t.Error("tried to resume a response that didn't support it")
+		return nil, errConnectionDropped
+	}
+
+	noRanges := resumableResponse("Test response body.", 10)
+	noRanges.Header.Del("Accept-Ranges")
+	weakValidator := resumableResponse("Test response body.", 10)
+	weakValidator.Header.Set("ETag", `W/"v1"`)
+
+	for _, res := range []*http.Response{noRanges, weakValidator} {
+		body := res.Body
+		if ResumeInterruptedBody(context.Background(), res, 3, resume).Body != body {
+			t.Errorf("expected the body not to be wrapped for %v", res.Header)
+		}
+	}
+
+	lastModified := resumableResponse("Test response body.", 10)
+	lastModified.Header.Del("ETag")
+	lastModified.Header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	if _, ok := ResumeInterruptedBody(context.Background(), lastModified, 3, resume).Body.(*resumingBody); !ok {
+		t.Error("expected the body to be wrapped when there's a Last-Modified validator")
+	}
+}
+
+func TestResumedBodyIsCached(t *testing.T) {
+	cache.Clear()
+	body := "Test response body that gets interrupted."
+	res, err := cache.Get("aaaa", func() (*http.Response, error) {
+		return ResumeInterruptedBody(context.Background(), resumableResponse(body, 10), 3, func(rangeHeaders http.Header) (*http.Response, error) {
+			res := partialResponse(body, 10, len(body), "bytes 10-40/41")
+			res.Body = ioutil.NopCloser(bytes.NewReader([]byte(body[10:])))
+			return res, nil
+		}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != body {
+		t.Errorf("expected %q, got %q", body, data)
+	}
+	assertCached(t, "test/cache/aaaa", true)
+}
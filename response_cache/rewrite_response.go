@@ -0,0 +1,71 @@
+package response_cache
+
+import "bytes"
+import "io"
+import "net/http"
+import "strings"
+
+// ReplaceInResponse changes the response so that its body has every occurrence of old replaced by
+// new.  the body is rewritten as it's read, so the length of the response is no longer known, and
+// its ETag is weakened since the body is no longer byte-for-byte what the server sent.
+func ReplaceInResponse(res *http.Response, old string, new string) {
+	res.Body = &replacingBody{body: res.Body, old: []byte(old), new: []byte(new)}
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+type replacingBody struct {
+	body   io.ReadCloser
+	old    []byte
+	new    []byte
+	input  []byte
+	output []byte
+	err    error
+}
+
+func (r *replacingBody) Read(p []byte) (int, error) {
+	for len(r.output) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var chunk [32768]byte
+		n, err := r.body.Read(chunk[:])
+		r.input = append(r.input, chunk[:n]...)
+		r.err = err
+		r.replace()
+	}
+
+	n := copy(p, r.output)
+	r.output = r.output[n:]
+	return n, nil
+}
+
+func (r *replacingBody) replace() {
+	for {
+		index := bytes.Index(r.input, r.old)
+		if index < 0 {
+			break
+		}
+		r.output = append(r.output, r.input[:index]...)
+		r.output = append(r.output, r.new...)
+		r.input = r.input[index+len(r.old):]
+	}
+
+	// hold back anything that could be the start of a match that continues in the next chunk,
+	// unless there's nothing more to come
+	keep := len(r.old) - 1
+	if r.err != nil {
+		keep = 0
+	} else if keep > len(r.input) {
+		keep = len(r.input)
+	}
+	r.output = append(r.output, r.input[:len(r.input)-keep]...)
+	r.input = append([]byte(nil), r.input[len(r.input)-keep:]...)
+}
+
+func (r *replacingBody) Close() error {
+	return r.body.Close()
+}
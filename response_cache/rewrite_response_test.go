@@ -0,0 +1,51 @@
+package response_cache
+
+import "testing"
+
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "testing/iotest"
+
+func rewrittenBody(t *testing.T, body string, oneByteAtATime bool) (*http.Response, string) {
+	res := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Length": []string{"100"}, "Etag": []string{`"v1"`}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if oneByteAtATime {
+		res.Body = ioutil.NopCloser(iotest.OneByteReader(res.Body))
+	}
+	ReplaceInResponse(res, `"tarball":"https://registry/`, `"tarball":"http://proximate/registry/`)
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(data)
+}
+
+func TestReplaceInResponse(t *testing.T) {
+	body := `{"a":{"tarball":"https://registry/a.tgz"},"b":{"tarball":"https://registry/b.tgz"},"tarball":"https://other/c.tgz"}`
+	expected := `{"a":{"tarball":"http://proximate/registry/a.tgz"},"b":{"tarball":"http://proximate/registry/b.tgz"},"tarball":"https://other/c.tgz"}`
+
+	for _, oneByteAtATime := range []bool{false, true} {
+		res, data := rewrittenBody(t, body, oneByteAtATime)
+		if data != expected {
+			t.Errorf("expected %s, got %s", expected, data)
+		}
+		if res.ContentLength != -1 || res.Header.Get("Content-Length") != "" {
+			t.Errorf("expected the length to be unknown, got %d %v", res.ContentLength, res.Header)
+		}
+		if res.Header.Get("ETag") != `W/"v1"` {
+			t.Errorf("expected a weak ETag, got %s", res.Header.Get("ETag"))
+		}
+	}
+}
+
+func TestReplaceInResponseKeepsPartialMatches(t *testing.T) {
+	body := `{"tarball":"https://regis`
+	if _, data := rewrittenBody(t, body, true); data != body {
+		t.Errorf("expected %s, got %s", body, data)
+	}
+}
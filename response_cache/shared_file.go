@@ -7,29 +7,42 @@ type File interface {
 	io.Reader
 	io.ReaderAt
 	io.Writer
+	io.WriterAt
 	io.Closer
 	Sync() error
 }
 
 type SharedFile struct {
-	cond   sync.Cond
-	file   File
-	refs   int64
-	length int64
-	err    error
+	cond         sync.Cond
+	file         File
+	refs         int64
+	length       int64
+	err          error
+	unreferenced chan struct{}
+
+	// called before the readers are failed because a write failed
+	beforeFailing func()
 }
 
 func NewSharedFile(f File) *SharedFile {
 	return &SharedFile{
-		cond:   sync.Cond{L: &sync.Mutex{}},
-		file:   f,
-		refs:   1,
-		length: 0,
+		cond:         sync.Cond{L: &sync.Mutex{}},
+		file:         f,
+		refs:         1,
+		length:       0,
+		unreferenced: make(chan struct{}, 1),
 	}
 }
 
 func (sf *SharedFile) unreference() (err error) {
 	sf.refs -= 1
+
+	// let the writer know, in case it's no longer worth finishing the file
+	select {
+	case sf.unreferenced <- struct{}{}:
+	default:
+	}
+
 	if sf.refs == 0 {
 		err := sf.file.Close()
 		if err != nil {
@@ -47,21 +60,57 @@ func (sf *SharedFile) reference() error {
 	return nil
 }
 
+// references returns the number of references to the file, including the writer's, and the
+// number of bytes written so far.
+func (sf *SharedFile) references() (int64, int64) {
+	sf.cond.L.Lock()
+	defer sf.cond.L.Unlock()
+
+	return sf.refs, sf.length
+}
+
 func (sf *SharedFile) Write(p []byte) (n int, err error) {
 	n, err = sf.file.Write(p)
 
 	sf.cond.L.Lock()
 	defer sf.cond.L.Unlock()
 
+	// if the write failed, the readers must not mistake the end of what was written for the end of
+	// the file
 	sf.length += int64(n)
 	if err != nil {
-		sf.err = err
+		sf.fail(err)
 	}
 
 	sf.cond.Broadcast()
 	return n, err
 }
 
+// WriteAt overwrites part of what has already been written; it can't be used to extend the file.
+func (sf *SharedFile) WriteAt(p []byte, off int64) (n int, err error) {
+	sf.cond.L.Lock()
+	defer sf.cond.L.Unlock()
+
+	if off+int64(len(p)) > sf.length {
+		return 0, io.ErrShortWrite
+	}
+
+	n, err = sf.file.WriteAt(p, off)
+	if err != nil {
+		sf.fail(err)
+		sf.cond.Broadcast()
+	}
+	return n, err
+}
+
+// fail records a write error for the readers; the lock must be held.
+func (sf *SharedFile) fail(err error) {
+	if sf.beforeFailing != nil {
+		sf.beforeFailing()
+	}
+	sf.err = err
+}
+
 func (sf *SharedFile) Sync() (err error) {
 	err = sf.file.Sync()
 
@@ -107,6 +156,10 @@ type blockingReader struct {
 }
 
 func (sf *SharedFile) SpawnReader() (io.ReadCloser, error) {
+	return sf.spawnBlockingReader()
+}
+
+func (sf *SharedFile) spawnBlockingReader() (*blockingReader, error) {
 	sf.cond.L.Lock()
 	defer sf.cond.L.Unlock()
 
@@ -122,14 +175,21 @@ func (sf *SharedFile) SpawnReader() (io.ReadCloser, error) {
 }
 
 func (reader *blockingReader) Read(p []byte) (int, error) {
+	bread, err := reader.readAt(p, reader.position)
+	reader.position += int64(bread)
+	return bread, err
+}
+
+// readAt reads from anywhere in the file, waiting until there's something at that position to read
+// if it hasn't been written yet.  unlike io.ReaderAt, it returns as soon as it has read anything.
+func (reader *blockingReader) readAt(p []byte, off int64) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
 
 	for {
 		// try to read without the overhead of acquiring the mutex
-		bread, err := reader.sf.file.ReadAt(p, reader.position)
-		reader.position += int64(bread)
+		bread, err := reader.sf.file.ReadAt(p, off)
 
 		// if an IO error (other than EOF) occurs, return it
 		if err != nil && err != io.EOF {
@@ -143,7 +203,7 @@ func (reader *blockingReader) Read(p []byte) (int, error) {
 		}
 
 		// nothing left to read in the file (so far), so wait for more to arrive
-		err = reader.waitForMore()
+		err = reader.waitForMore(off)
 
 		// if that indicates that we've reached the true EOF, or any other error, return that
 		if err != nil {
@@ -152,12 +212,12 @@ func (reader *blockingReader) Read(p []byte) (int, error) {
 	}
 }
 
-func (reader *blockingReader) waitForMore() error {
+func (reader *blockingReader) waitForMore(off int64) error {
 	reader.sf.cond.L.Lock()
 	defer reader.sf.cond.L.Unlock()
 
 	for {
-		if reader.sf.length > reader.position {
+		if reader.sf.length > off {
 			return nil
 		}
 		if reader.sf.err != nil {
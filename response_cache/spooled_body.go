@@ -0,0 +1,145 @@
+package response_cache
+
+import "bytes"
+import "errors"
+import "io"
+import "io/ioutil"
+import "math"
+import "net/http"
+import "os"
+import "sync"
+
+// request bodies larger than this are spooled to a temporary file rather than kept in memory
+const maxInMemoryBody = 65536
+
+// requests with bodies larger than this aren't cached, unless the rule says otherwise, so that
+// clients can't fill up the temporary filesystem
+const DefaultMaxRequestBodySize = 16 << 20
+
+// used when we need the whole body regardless of its size; one less than the largest possible
+// limit, since we read one byte more than the limit to tell if the body is larger
+const noRequestBodyLimit = math.MaxInt64 - 1
+
+var errRequestBodyTooLarge = errors.New("request body is too large to cache")
+
+// spooledBody is a request body that we've read, so that we can read it again to hash it and then
+// send it upstream.  if the body was larger than the limit we were asked to read, we only keep
+// the part we read, and the rest is read from the original body when it's sent upstream.
+type spooledBody struct {
+	data      []byte
+	file      *os.File
+	size      int64
+	limit     int64 // the limit that the body was last found to be within
+	rest      io.ReadCloser
+	reader    io.Reader
+	closeOnce sync.Once
+}
+
+// spoolRequestBody reads the request body, keeping it in memory if it's small or in a temporary
+// file if not, and substitutes our copy for the original reader since we can't rewind that.  if
+// the body is larger than limit bytes, we stop reading and return errRequestBodyTooLarge; the
+// substituted body then reads the part that we've read followed by the rest of the original.
+func spoolRequestBody(req *http.Request, limit int64) (*spooledBody, error) {
+	spooled, ok := req.Body.(*spooledBody)
+	if !ok {
+		spooled = &spooledBody{rest: req.Body}
+		req.Body = spooled
+	}
+
+	if err := spooled.spool(limit); err != nil {
+		return nil, err
+	}
+	if spooled.size > limit {
+		return nil, errRequestBodyTooLarge
+	}
+	spooled.limit = limit
+	req.ContentLength = spooled.size
+	return spooled, nil
+}
+
+// spooledRequestBody returns the request body read by an earlier call to spoolRequestBody, or
+// reads the whole body if there wasn't one.
+func spooledRequestBody(req *http.Request) (*spooledBody, error) {
+	if spooled, ok := req.Body.(*spooledBody); ok && spooled.rest == nil {
+		return spooled, nil
+	}
+	return spoolRequestBody(req, noRequestBodyLimit)
+}
+
+// spool reads more of the original body, until we've read it all or read more than limit bytes.
+func (spooled *spooledBody) spool(limit int64) (err error) {
+	if spooled.rest != nil && spooled.size <= limit {
+		// read one byte more than the limit, so that we can tell if the body is larger
+		more := io.LimitReader(spooled.rest, limit+1-spooled.size)
+		if spooled.file == nil {
+			buffer := bytes.NewBuffer(spooled.data)
+			_, err = io.CopyN(buffer, more, maxInMemoryBody+1-spooled.size)
+			spooled.data, spooled.size = buffer.Bytes(), int64(buffer.Len())
+			if err == io.EOF {
+				err = nil
+			} else if err == nil {
+				err = spooled.spoolToFile(more)
+			}
+		} else {
+			var n int64
+			n, err = io.Copy(spooled.file, more)
+			spooled.size += n
+		}
+		if err != nil {
+			return err
+		}
+
+		// if we didn't reach the limit, we've read the whole body
+		if spooled.size <= limit {
+			spooled.rest.Close()
+			spooled.rest = nil
+		}
+	}
+
+	spooled.reader = spooled.newReader()
+	if spooled.rest != nil {
+		spooled.reader = io.MultiReader(spooled.reader, spooled.rest)
+	}
+	return nil
+}
+
+// spoolToFile moves the part of the body that we've read so far to a temporary file, and
+// continues reading into that.
+func (spooled *spooledBody) spoolToFile(r io.Reader) error {
+	file, err := ioutil.TempFile("", "proximate-body")
+	if err != nil {
+		return err
+	}
+
+	// we only need the file while it's open, so remove it now, then it can't be left behind
+	os.Remove(file.Name())
+	spooled.file = file
+	spooled.size, err = io.Copy(file, io.MultiReader(bytes.NewReader(spooled.data), r))
+	spooled.data = nil
+	return err
+}
+
+// newReader returns a reader for the part of the body that we've read, independent of any other
+// reader.
+func (spooled *spooledBody) newReader() io.Reader {
+	if spooled.file != nil {
+		return io.NewSectionReader(spooled.file, 0, spooled.size)
+	}
+	return bytes.NewReader(spooled.data)
+}
+
+func (spooled *spooledBody) Read(p []byte) (int, error) {
+	return spooled.reader.Read(p)
+}
+
+func (spooled *spooledBody) Close() (err error) {
+	spooled.closeOnce.Do(func() {
+		if spooled.rest != nil {
+			err = spooled.rest.Close()
+		}
+		if spooled.file != nil {
+			err = spooled.file.Close()
+		}
+	})
+	return
+}
@@ -0,0 +1,84 @@
+package response_cache
+
+import "testing"
+
+import "io/ioutil"
+import "net/http"
+import "strings"
+
+func requestWithBody(body string, contentLength int64) *http.Request {
+	req, _ := http.NewRequest("POST", "http://example.com/some/path", ioutil.NopCloser(strings.NewReader(body)))
+	req.ContentLength = contentLength
+	return req
+}
+
+func TestSpooledBodies(t *testing.T) {
+	small := "small request body"
+	large := strings.Repeat("large request body ", maxInMemoryBody)
+
+	for _, body := range []string{small, large} {
+		for _, contentLength := range []int64{int64(len(body)), -1} {
+			req := requestWithBody(body, contentLength)
+			hash, err := HashRequestAndBody(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spooled := req.Body.(*spooledBody)
+			if (spooled.file != nil) != (len(body) > maxInMemoryBody) {
+				t.Errorf("expected only bodies over %d bytes to be spooled to a file", maxInMemoryBody)
+			}
+			if req.ContentLength != int64(len(body)) {
+				t.Errorf("expected the content length to be %d, got %d", len(body), req.ContentLength)
+			}
+
+			// hashing again should give the same result, and leave the body ready to send upstream
+			if again, _ := HashRequestAndBody(req); again != hash {
+				t.Error("expected the same hash for the same body")
+			}
+			if data, _ := ioutil.ReadAll(req.Body); string(data) != body {
+				t.Errorf("expected the body to be kept, got %d bytes", len(data))
+			}
+			req.Body.Close()
+			req.Body.Close()
+		}
+	}
+}
+
+func TestSpooledBodiesHashDifferently(t *testing.T) {
+	large := strings.Repeat("large request body ", maxInMemoryBody)
+	hash, _ := HashRequestAndBody(requestWithBody(large, -1))
+	if other, _ := HashRequestAndBody(requestWithBody(large+"!", -1)); other == hash {
+		t.Error("hash did not vary on large body content changes")
+	}
+}
+
+func TestSpooledBodiesOverTheLimit(t *testing.T) {
+	large := strings.Repeat("large request body ", maxInMemoryBody)
+
+	for _, limit := range []int64{1000, maxInMemoryBody * 2} {
+		req := requestWithBody(large, -1)
+		if _, err := spoolRequestBody(req, limit); err != errRequestBodyTooLarge {
+			t.Errorf("expected the body to be too large for a limit of %d, got %v", limit, err)
+		}
+		if spooled := req.Body.(*spooledBody); spooled.size != limit+1 {
+			t.Errorf("expected to stop reading at %d bytes, read %d", limit+1, spooled.size)
+		}
+
+		// a larger limit carries on from where we stopped
+		if _, err := spoolRequestBody(req, int64(len(large))); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := ioutil.ReadAll(req.Body); string(data) != large {
+			t.Errorf("expected the body to be kept, got %d bytes", len(data))
+		}
+		req.Body.Close()
+	}
+
+	// if we don't carry on, the rest of the body is read from the original
+	req := requestWithBody(large, -1)
+	spoolRequestBody(req, maxInMemoryBody*2)
+	if data, _ := ioutil.ReadAll(req.Body); string(data) != large {
+		t.Errorf("expected the whole body to be sent upstream, got %d bytes", len(data))
+	}
+	req.Body.Close()
+}
@@ -0,0 +1,280 @@
+package response_cache
+
+import "testing"
+
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "sync/atomic"
+import "time"
+
+var errUpstreamUnreachable = errors.New("upstream unreachable")
+
+func expireEntry(t *testing.T, path string) {
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func failingMiss() (*http.Response, error) {
+	return nil, errUpstreamUnreachable
+}
+
+func readBody(t *testing.T, res *http.Response, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return string(data)
+}
+
+func TestMissErrorsAreReturned(t *testing.T) {
+	cache.Clear()
+	res, err := cache.Get("aaaa", failingMiss)
+	if res != nil || err != errUpstreamUnreachable {
+		t.Errorf("expected the miss error, got %v %v", res, err)
+	}
+	assertCached(t, "test/cache/aaaa", false)
+}
+
+func TestGetFreshServesUnexpiredEntries(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "first version")
+
+	res, err := cache.GetFresh("aaaa", time.Hour, cacheEntry200("second version"))
+	if body := readBody(t, res, err); body != "first version" {
+		t.Errorf("expected the cached entry, got %q", body)
+	}
+}
+
+func TestGetFreshRefetchesExpiredEntries(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "first version")
+	expireEntry(t, "test/cache/aaaa")
+
+	res, err := cache.GetFresh("aaaa", time.Hour, cacheEntry200("second version"))
+	if body := readBody(t, res, err); body != "second version" {
+		t.Errorf("expected the new version, got %q", body)
+	}
+
+	// and the new version should have replaced the old one
+	res, err = cache.GetFresh("aaaa", time.Hour, failingMiss)
+	if body := readBody(t, res, err); body != "second version" {
+		t.Errorf("expected the new version to be cached, got %q", body)
+	}
+}
+
+func TestGetFreshReturnsErrorsByDefault(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "first version")
+	expireEntry(t, "test/cache/aaaa")
+
+	res, err := cache.GetFresh("aaaa", time.Hour, failingMiss)
+	if res != nil || err != errUpstreamUnreachable {
+		t.Errorf("expected the miss error, got %v %v", res, err)
+	}
+}
+
+func TestGetFreshServesStaleEntriesOnError(t *testing.T) {
+	cache.Clear()
+	resilientCache := NewDiskCache("test/cache", DiskCacheOptions{ServeStaleOnError: true})
+	getAndClose(t, resilientCache, "aaaa", "first version")
+	expireEntry(t, "test/cache/aaaa")
+
+	originalLogCacheError := logCacheError
+	var errorLogs []string
+	logCacheError = func(format string, a ...interface{}) { errorLogs = append(errorLogs, fmt.Sprintf(format, a...)) }
+	defer func() { logCacheError = originalLogCacheError }()
+
+	serverError := func() (*http.Response, error) {
+		res, err := cacheEntry200("Service Unavailable")()
+		res.StatusCode = 503
+		res.Status = "503 Service Unavailable"
+		return res, err
+	}
+
+	for _, miss := range []func() (*http.Response, error){failingMiss, serverError} {
+		res, err := resilientCache.GetFresh("aaaa", time.Hour, miss)
+		if err != ServedStale {
+			t.Fatalf("expected ServedStale, got %v", err)
+		}
+		if res.Header.Get("Warning") != `111 - "Revalidation Failed"` {
+			t.Errorf("expected a Warning header, got %v", res.Header)
+		}
+		if body := readBody(t, res, nil); body != "first version" {
+			t.Errorf("expected the stale entry, got %q", body)
+		}
+	}
+
+	expected := []string{
+		"Error refreshing cache path test/cache/aaaa, serving stale entry: upstream unreachable\n",
+		"Error refreshing cache path test/cache/aaaa, serving stale entry: 503 Service Unavailable\n",
+	}
+	if fmt.Sprint(errorLogs) != fmt.Sprint(expected) {
+		t.Errorf("expected error logs %v, got %v", expected, errorLogs)
+	}
+
+	// the stale entry should still be there for next time
+	assertCached(t, "test/cache/aaaa", true)
+}
+
+func TestGetFreshServesStaleEntriesToAllWaitersOnError(t *testing.T) {
+	cache.Clear()
+	resilientCache := NewDiskCache("test/cache", DiskCacheOptions{ServeStaleOnError: true})
+	getAndClose(t, resilientCache, "aaaa", "first version")
+	expireEntry(t, "test/cache/aaaa")
+
+	originalLogCacheError := logCacheError
+	logCacheError = func(format string, a ...interface{}) {}
+	defer func() { logCacheError = originalLogCacheError }()
+
+	var fetches int32
+	fetching, failNow := make(chan struct{}), make(chan struct{})
+	miss := func() (*http.Response, error) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			close(fetching)
+		}
+		<-failNow
+		return failingMiss()
+	}
+
+	results := make(chan string)
+	get := func() {
+		res, err := resilientCache.GetFresh("aaaa", time.Hour, miss)
+		if err != ServedStale {
+			results <- fmt.Sprintf("error %v", err)
+			return
+		}
+		results <- readBody(t, res, nil)
+	}
+
+	// start the fill, then have two more clients wait for it before it fails
+	go get()
+	<-fetching
+	go get()
+	go get()
+	time.Sleep(50 * time.Millisecond)
+	close(failNow)
+
+	for i := 0; i < 3; i++ {
+		if body := <-results; body != "first version" {
+			t.Errorf("expected the stale entry, got %q", body)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected the waiters to share the failed fetch, but it was fetched %d times", fetches)
+	}
+}
+
+func revalidatedResponse(status int, body string, validators *http.Header) func(http.Header) (*http.Response, error) {
+	return func(header http.Header) (*http.Response, error) {
+		*validators = header
+		res, err := cacheEntry200(body)()
+		res.StatusCode = status
+		return res, err
+	}
+}
+
+func TestGetRevalidatedSendsValidators(t *testing.T) {
+	cache.Clear()
+	res, err := cache.GetRevalidated("aaaa", time.Hour, func(header http.Header) (*http.Response, error) {
+		res, err := cacheEntry200("first version")()
+		res.Header.Set("ETag", `"v1"`)
+		res.Header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		return res, err
+	})
+	readBody(t, res, err)
+	expireEntry(t, "test/cache/aaaa")
+
+	var validators http.Header
+	res, err = cache.GetRevalidated("aaaa", time.Hour, revalidatedResponse(http.StatusNotModified, "", &validators))
+	if body := readBody(t, res, err); body != "first version" {
+		t.Errorf("expected the cached entry, got %q", body)
+	}
+	if validators.Get("If-None-Match") != `"v1"` || validators.Get("If-Modified-Since") != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("expected the cached validators, got %v", validators)
+	}
+
+	// and the entry should be fresh again
+	res, err = cache.GetRevalidated("aaaa", time.Hour, func(http.Header) (*http.Response, error) { return failingMiss() })
+	if body := readBody(t, res, err); body != "first version" {
+		t.Errorf("expected the revalidated entry, got %q", body)
+	}
+
+	// but if it has changed, the new version replaces it
+	expireEntry(t, "test/cache/aaaa")
+	res, err = cache.GetRevalidated("aaaa", time.Hour, revalidatedResponse(http.StatusOK, "second version", &validators))
+	if body := readBody(t, res, err); body != "second version" {
+		t.Errorf("expected the new version, got %q", body)
+	}
+}
+
+func TestGetRevalidatedWithoutValidators(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "first version")
+	expireEntry(t, "test/cache/aaaa")
+
+	var validators http.Header
+	res, err := cache.GetRevalidated("aaaa", time.Hour, revalidatedResponse(http.StatusOK, "second version", &validators))
+	if body := readBody(t, res, err); body != "second version" {
+		t.Errorf("expected the new version, got %q", body)
+	}
+	if len(validators) != 0 {
+		t.Errorf("expected no validators, got %v", validators)
+	}
+}
+
+func TestAliasLegacyEntries(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "old key format")
+
+	if aliased, err := cache.Alias("aaaa", "01aaaa"); !aliased || err != nil {
+		t.Fatalf("expected the entry to be aliased, got %v %v", aliased, err)
+	}
+	res, err := cache.Get("01aaaa", failingMiss)
+	if body := readBody(t, res, err); body != "old key format" {
+		t.Errorf("expected the entry stored under the old key, got %q", body)
+	}
+	assertCached(t, "test/cache/aaaa", true)
+
+	// but existing entries under the new key aren't replaced
+	getAndClose(t, cache, "01bbbb", "new key format")
+	getAndClose(t, cache, "bbbb", "old key format")
+	if aliased, err := cache.Alias("bbbb", "01bbbb"); aliased || err != nil {
+		t.Fatalf("expected the entry not to be aliased, got %v %v", aliased, err)
+	}
+	res, err = cache.Get("01bbbb", failingMiss)
+	if body := readBody(t, res, err); body != "new key format" {
+		t.Errorf("expected the entry stored under the new key, got %q", body)
+	}
+
+	// and there's nothing to do if there's no old entry
+	if aliased, err := cache.Alias("cccc", "01cccc"); aliased || err != nil {
+		t.Fatalf("expected nothing to be aliased, got %v %v", aliased, err)
+	}
+	assertCached(t, "test/cache/01cccc", false)
+}
+
+func TestGetServesAliasedEntries(t *testing.T) {
+	cache.Clear()
+	getAndClose(t, cache, "aaaa", "old key format")
+
+	fetches := 0
+	res, err := cache.GetRevalidated("01aaaa", 0, func(validators http.Header) (*http.Response, error) {
+		fetches++
+		if _, err := cache.Alias("aaaa", "01aaaa"); err != nil {
+			return nil, err
+		}
+		return nil, Aliased
+	})
+	if body := readBody(t, res, err); body != "old key format" {
+		t.Errorf("expected the entry stored under the old key, got %q", body)
+	}
+	if fetches != 1 {
+		t.Errorf("expected 1 fetch, got %d", fetches)
+	}
+}
@@ -0,0 +1,95 @@
+package response_cache
+
+import "errors"
+import "io"
+import "os"
+import "sync"
+import "time"
+
+// how often to check for more data when following a fill being made by another process
+var tailPollInterval = 100 * time.Millisecond
+
+var errFillAbandoned = errors.New("fill was abandoned by the other process")
+
+// tailingReader reads a cache entry that another process is still filling.  we can't be woken up
+// when it writes more like blockingReader can, so we poll.
+type tailingReader struct {
+	file     *os.File
+	path     string
+	tempPath string
+	mutex    sync.Mutex
+	finished bool
+	err      error
+}
+
+// openTail opens the temporary file the other process is filling, or if it has finished already,
+// the published entry.
+func openTail(path string, tempPath string) (entryReader, error) {
+	file, err := os.Open(tempPath)
+	if os.IsNotExist(err) {
+		file, err := osOpen(path)
+		if err != nil {
+			return nil, err
+		}
+		return &completeEntry{file}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &tailingReader{file: file, path: path, tempPath: tempPath}, nil
+}
+
+func (reader *tailingReader) readAt(p []byte, off int64) (int, error) {
+	for {
+		// ReadAt returns EOF along with a short read, but more may yet be written
+		n, err := reader.file.ReadAt(p, off)
+		if n > 0 {
+			return n, nil
+		} else if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		reader.mutex.Lock()
+		finished, finishedErr := reader.finished, reader.err
+		reader.mutex.Unlock()
+
+		if finished {
+			if finishedErr != nil {
+				return 0, finishedErr
+			}
+			return 0, io.EOF
+		}
+
+		// we've caught up with the other process; check if it's done before waiting for more.  if it
+		// has finished, we loop around once more to read anything written after our last read.
+		if fillFinished(reader.path, reader.tempPath) {
+			reader.mutex.Lock()
+			reader.finished = true
+			if !sameFileAsPath(reader.file, reader.path) {
+				reader.err = errFillAbandoned
+			}
+			reader.mutex.Unlock()
+		} else {
+			time.Sleep(tailPollInterval)
+		}
+	}
+}
+
+func (reader *tailingReader) Close() error {
+	return reader.file.Close()
+}
+
+// fillFinished returns true if the other process filling the entry has published it, given up on
+// it, or died.
+func fillFinished(path string, tempPath string) bool {
+	if _, err := os.Stat(tempPath); os.IsNotExist(err) {
+		return true
+	}
+	return !entryLocked(path)
+}
+
+// waitForFill blocks until the other process filling the entry is finished.
+func waitForFill(path string, tempPath string) {
+	for !fillFinished(path, tempPath) {
+		time.Sleep(tailPollInterval)
+	}
+}
@@ -1,18 +1,23 @@
 package response_cache
 
 import "net/url"
+import "path"
 import "sort"
 import "strings"
 
 type Paths []string
 
+// Upstreams is a list of servers, each optionally followed by a path prefix.  host names may
+// contain * wildcards (eg. "*.archive.ubuntu.com").
 type Upstreams struct {
-	hosts map[string]Paths
+	hosts    map[string]Paths
+	patterns map[string]Paths
 }
 
 func NewUpstreams(cacheServers string) *Upstreams {
 	result := Upstreams{
-		hosts: make(map[string]Paths),
+		hosts:    make(map[string]Paths),
+		patterns: make(map[string]Paths),
 	}
 
 	sortedServers := sort.StringSlice(strings.Split(cacheServers, ","))
@@ -25,26 +30,54 @@ func NewUpstreams(cacheServers string) *Upstreams {
 		if len(segments) > 1 {
 			path = "/" + segments[1]
 		}
-		result.hosts[host] = append(result.hosts[host], path)
+		if strings.Contains(host, "*") {
+			result.patterns[host] = append(result.patterns[host], path)
+		} else {
+			result.hosts[host] = append(result.hosts[host], path)
+		}
 	}
 
 	return &result
 }
 
 func (upstreams *Upstreams) UpstreamListed(url *url.URL) bool {
-	if paths, ok := upstreams.hosts[url.Host]; ok {
-		// although the docs say url.Parse will set both Path and RawPath, the requests passed in
-		// from ServePath only seem to set RawPath if there were encoded characters.  but if there
-		// were, we want to use RawPath so we correctly handle matching / characters etc.
-		urlPath := url.Path
-		if url.RawPath != "" {
-			urlPath = url.RawPath
+	if paths, ok := upstreams.hosts[url.Host]; ok && pathListed(url, paths) {
+		return true
+	}
+	for pattern, paths := range upstreams.patterns {
+		if matched, _ := path.Match(pattern, url.Host); matched && pathListed(url, paths) {
+			return true
 		}
+	}
+	return false
+}
+
+// HostListed returns true if any path on the server is listed.
+func (upstreams *Upstreams) HostListed(host string) bool {
+	host = strings.ToLower(host)
+	if _, ok := upstreams.hosts[host]; ok {
+		return true
+	}
+	for pattern := range upstreams.patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func pathListed(url *url.URL, paths Paths) bool {
+	// although the docs say url.Parse will set both Path and RawPath, the requests passed in
+	// from ServePath only seem to set RawPath if there were encoded characters.  but if there
+	// were, we want to use RawPath so we correctly handle matching / characters etc.
+	urlPath := url.Path
+	if url.RawPath != "" {
+		urlPath = url.RawPath
+	}
 
-		for _, path := range paths {
-			if strings.HasPrefix(urlPath, path) {
-				return true
-			}
+	for _, path := range paths {
+		if strings.HasPrefix(urlPath, path) {
+			return true
 		}
 	}
 	return false
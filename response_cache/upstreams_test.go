@@ -54,3 +54,31 @@ func TestUpstreams(t *testing.T) {
 	empty = NewUpstreams(",")
 	assertNotListed(t, empty, "https://gitxyz.com/")
 }
+
+func TestUpstreamsWithWildcards(t *testing.T) {
+	upstreams := NewUpstreams("*.archive.ubuntu.com/ubuntu/,mirror-*.example.com")
+
+	assertListed(t, upstreams, "http://au.archive.ubuntu.com/ubuntu/pool/main/test.deb")
+	assertListed(t, upstreams, "http://us.archive.ubuntu.com/ubuntu/")
+	assertNotListed(t, upstreams, "http://archive.ubuntu.com/ubuntu/")
+	assertNotListed(t, upstreams, "http://au.archive.ubuntu.com/debian/")
+	assertNotListed(t, upstreams, "http://au.archive.ubuntu.com.example.com/ubuntu/")
+
+	assertListed(t, upstreams, "https://mirror-1.example.com/whatever")
+	assertNotListed(t, upstreams, "https://mirror.example.com/whatever")
+}
+
+func TestUpstreamsHostListed(t *testing.T) {
+	upstreams := NewUpstreams("github.com/willbryant,*.ubuntu.com")
+	for host, expected := range map[string]bool{
+		"github.com":             true,
+		"GitHub.com":             true,
+		"archive.ubuntu.com":     true,
+		"gitlab.com":             false,
+		"ubuntu.com.example.com": false,
+	} {
+		if upstreams.HostListed(host) != expected {
+			t.Errorf("expected HostListed to be %v for %s", expected, host)
+		}
+	}
+}
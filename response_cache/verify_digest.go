@@ -0,0 +1,50 @@
+package response_cache
+
+import "encoding/hex"
+import "errors"
+import "hash"
+import "io"
+import "net/http"
+import "strings"
+
+var ErrDigestMismatch = errors.New("response body doesn't match its digest")
+
+// VerifyDigest changes the response so that reading its body to the end fails with
+// ErrDigestMismatch, rather than io.EOF, unless the body hashes to the expected hex digest using
+// the named algorithm.  since the cache only keeps entries that are read to the end, this stops
+// corrupt or substituted responses being cached.
+func VerifyDigest(res *http.Response, algorithm string, expected string) {
+	VerifyDigestLater(res, algorithm, func() string { return expected })
+}
+
+// VerifyDigestLater is like VerifyDigest, but only calls expected to get the digest once the body
+// has been read, so that it can be fetched at the same time as the body.  if it returns an empty
+// string, the digest isn't known and the body isn't checked.
+func VerifyDigestLater(res *http.Response, algorithm string, expected func() string) {
+	res.Body = &verifyingBody{
+		body:     res.Body,
+		hasher:   newChecksum(algorithm),
+		expected: expected,
+	}
+}
+
+type verifyingBody struct {
+	body     io.ReadCloser
+	hasher   hash.Hash
+	expected func() string
+}
+
+func (v *verifyingBody) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	v.hasher.Write(p[:n])
+	if err == io.EOF {
+		if expected := strings.ToLower(v.expected()); expected != "" && hex.EncodeToString(v.hasher.Sum(nil)) != expected {
+			return n, ErrDigestMismatch
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingBody) Close() error {
+	return v.body.Close()
+}
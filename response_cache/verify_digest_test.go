@@ -0,0 +1,54 @@
+package response_cache
+
+import "testing"
+
+import "io/ioutil"
+import "net/http"
+
+func TestVerifyDigest(t *testing.T) {
+	body := "Test response body."
+	sha256 := "a0e8d2b44a7dfb5e09d0d9ff8b1c1d6e0b7a1a1b1f3f0e6f4d0d0b4d2a5b6c7d"
+
+	res, _ := cacheEntry200(body)()
+	VerifyDigest(res, "sha256", sha256)
+	if data, err := ioutil.ReadAll(res.Body); err != ErrDigestMismatch || string(data) != body {
+		t.Errorf("expected the body then a digest mismatch, got %q %v", data, err)
+	}
+
+	res, _ = cacheEntry200(body)()
+	VerifyDigest(res, "sha256", HashString(body))
+	if data, err := ioutil.ReadAll(res.Body); err != nil || string(data) != body {
+		t.Errorf("expected the body, got %q %v", data, err)
+	}
+}
+
+func TestVerifyDigestLater(t *testing.T) {
+	body := "Test response body."
+
+	res, _ := cacheEntry200(body)()
+	VerifyDigestLater(res, "sha256", func() string { return HashString("Some other body.") })
+	if data, err := ioutil.ReadAll(res.Body); err != ErrDigestMismatch || string(data) != body {
+		t.Errorf("expected the body then a digest mismatch, got %q %v", data, err)
+	}
+
+	res, _ = cacheEntry200(body)()
+	VerifyDigestLater(res, "sha256", func() string { return "" })
+	if data, err := ioutil.ReadAll(res.Body); err != nil || string(data) != body {
+		t.Errorf("expected the body when the digest isn't known, got %q %v", data, err)
+	}
+}
+
+func TestVerifyDigestStopsCaching(t *testing.T) {
+	cache.Clear()
+	res, err := cache.Get("aaaa", func() (*http.Response, error) {
+		res, err := cacheEntry200("Test response body.")()
+		VerifyDigest(res, "sha256", HashString("Some other body."))
+		return res, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assertCached(t, "test/cache/aaaa", false)
+}
@@ -1,6 +1,9 @@
 package main
 
+import "bufio"
+import "errors"
 import "fmt"
+import "net"
 import "net/http"
 import "os"
 import "strings"
@@ -43,12 +46,28 @@ func (logger *responseLogger) Write(bytes []byte) (int, error) {
 	return logger.w.Write(bytes)
 }
 
+func (logger *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := logger.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be taken over")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		logger.StatusCode = http.StatusOK
+	}
+	return conn, rw, err
+}
+
 func (logger *responseLogger) ClfLog() {
+	target := logger.req.URL.String()
+	if logger.req.Method == "CONNECT" {
+		target = logger.req.Host
+	}
 	fmt.Fprintf(os.Stdout, "%s - - %s \"%s %s %s\" %d %d\n",
 		RequestIP(logger.req),
 		ClfTime(),
 		logger.req.Method,
-		logger.req.URL,
+		target,
 		logger.req.Proto,
 		logger.StatusCode,
 		logger.Bytes)
@@ -1,6 +1,10 @@
 package main
 
+import "context"
+import "crypto/tls"
+import "errors"
 import "fmt"
+import "io"
 import "net"
 import "net/http"
 import "os"
@@ -9,25 +13,33 @@ import "github.com/willbryant/proximate/response_cache/httputil"
 import "strings"
 
 type proximateServer struct {
-	Listener         net.Listener
-	Tracker          *ConnectionTracker
-	Closed           uint32
-	Quiet            bool
-	Cache            response_cache.ResponseCache
-	GitPackUpstreams *response_cache.Upstreams
-	DebPoolUpstreams *response_cache.Upstreams
-	Proxy            *httputil.ReverseProxy
+	Listener      net.Listener
+	PlainListener net.Listener
+	TLSConfig     *tls.Config
+	Tracker       *ConnectionTracker
+	Closed        uint32
+	Quiet         bool
+	Cache         response_cache.ResponseCache
+	Rules         response_cache.CacheRules
+	Tunnels       TunnelAllowlist
+	Interceptor   *CertificateAuthority
+	Proxy         *httputil.ReverseProxy
+	ResumeRetries int
 }
 
-func ProximateServer(listener net.Listener, cacheDirectory string, gitPackUpstreams string, debPoolUpstreams string, quiet bool) proximateServer {
+func ProximateServer(listener net.Listener, tlsConfig *tls.Config, plainListener net.Listener, cacheDirectory string, cacheOptions response_cache.DiskCacheOptions, rules response_cache.CacheRules, tunnels TunnelAllowlist, interceptor *CertificateAuthority, resumeRetries int, quiet bool) proximateServer {
 	return proximateServer{
-		Listener:         listener,
-		Tracker:          NewConnectionTracker(),
-		Quiet:            quiet,
-		Cache:            response_cache.NewDiskCache(cacheDirectory),
-		GitPackUpstreams: response_cache.NewUpstreams(gitPackUpstreams),
-		DebPoolUpstreams: response_cache.NewUpstreams(debPoolUpstreams),
-		Proxy:            &httputil.ReverseProxy{Director: setProxyUserAgentDirector},
+		Listener:      listener,
+		PlainListener: plainListener,
+		TLSConfig:     tlsConfig,
+		Tracker:       NewConnectionTracker(),
+		Quiet:         quiet,
+		ResumeRetries: resumeRetries,
+		Cache:         response_cache.NewDiskCache(cacheDirectory, cacheOptions),
+		Rules:         rules,
+		Tunnels:       tunnels,
+		Interceptor:   interceptor,
+		Proxy:         &httputil.ReverseProxy{Director: setProxyUserAgentDirector},
 	}
 }
 
@@ -39,42 +51,102 @@ func setProxyUserAgentDirector(req *http.Request) {
 	fmt.Fprintf(os.Stdout, "proxying %s request to %s\n", req.Method, req.URL)
 }
 
-func cachableGitPackRequest(req *http.Request) bool {
-	return req.ContentLength > 0 && req.ContentLength < 65536 && // arbitrary
-		req.Method == "POST" &&
-		req.Header.Get("Content-Type") == "application/x-git-upload-pack-request" &&
-		req.Header.Get("Accept") == "application/x-git-upload-pack-result" &&
-		req.Header.Get("Cache-Control") == "" &&
-		req.Header.Get("Authorization") == ""
-}
+func (server proximateServer) serveCacheableRequest(rw http.ResponseWriter, req *http.Request, rule *response_cache.CacheRule) {
+	// always fetch and cache the full response, and serve any range or conditional response
+	// requested from that
+	conditionalHeaders := response_cache.TakeConditionalHeaders(req)
 
-func cacheableDebPoolRequest(req *http.Request) bool {
-	return req.Method == "GET" &&
-		req.Header.Get("Cache-Control") == "" &&
-		req.Header.Get("Authorization") == "" &&
-		strings.HasSuffix(req.URL.Path, ".deb") &&
-		strings.Contains(req.URL.Path, "/pool/")
-}
+	if req.Method == "HEAD" {
+		server.serveCachedHead(rw, req, rule, conditionalHeaders)
+		return
+	}
 
-func (server proximateServer) serveCacheableRequest(rw http.ResponseWriter, req *http.Request) {
-	hash, err := response_cache.HashRequestAndBody(req)
+	hash, err := rule.Key(req)
 	if err != nil {
 		http.Error(rw, err.Error(), 401)
+		return
 	}
 
-	forwarded := false
-	res, err := server.Cache.Get(hash, func() (*http.Response, error) {
+	// if the rule rewrites responses, we need to be able to read them, so don't ask for compression
+	upstreamReq := *req
+	upstreamReq.Header = make(http.Header)
+	response_cache.CopyHeader(upstreamReq.Header, req.Header)
+	if rule.Rewrite != nil {
+		upstreamReq.Header.Del("Accept-Encoding")
+	}
+
+	forwarded, notModified, aliased := false, false, false
+	res, err := server.Cache.GetRevalidated(hash, rule.TTL.Duration, func(validators http.Header) (*http.Response, error) {
+		// only look for a legacy entry once, in case it can't be served
+		if !aliased {
+			aliased = true
+			if server.aliasLegacyEntry(req, rule, hash) {
+				return nil, response_cache.Aliased
+			}
+		}
 		forwarded = true
-		// TODO: never cancel, or at least only cancel if all clients abort?
-		return server.Proxy.Forward(server.Proxy.CancelContext(rw, req), req)
+		// other clients may be waiting for the same response, so the fill mustn't be cancelled if
+		// this client disconnects; but the cache closes the response body if it gives up on the
+		// fill, and then we cancel anything we're still fetching for it
+		ctx, cancel := context.WithCancel(context.Background())
+		fetchReq := upstreamReq
+		fetchReq.Header = make(http.Header)
+		response_cache.CopyHeader(fetchReq.Header, upstreamReq.Header)
+		response_cache.CopyHeader(fetchReq.Header, validators)
+		res, err := server.Proxy.Forward(ctx, &fetchReq)
+		if err == nil && rule.FollowRedirects {
+			res, err = server.followRedirects(ctx, &fetchReq, res)
+		}
+		if err != nil {
+			cancel()
+			return res, err
+		}
+		if res.StatusCode == http.StatusNotModified {
+			notModified = true
+			return cancelOnClose(res, cancel), nil
+		}
+		if !rule.CacheableSize(res) {
+			return cancelOnClose(res, cancel), response_cache.Uncacheable
+		}
+		if req.Method != "GET" {
+			return cancelOnClose(res, cancel), nil
+		}
+
+		// if the connection drops partway through, try to fetch the rest rather than failing
+		// everyone waiting for the response
+		res = response_cache.ResumeInterruptedBody(ctx, res, server.ResumeRetries, func(rangeHeaders http.Header) (*http.Response, error) {
+			fmt.Fprintf(os.Stdout, "%s request to %s was interrupted, resuming with %s\n", req.Method, req.URL, rangeHeaders.Get("Range"))
+			resumeReq := fetchReq
+			resumeReq.Header = make(http.Header)
+			response_cache.CopyHeader(resumeReq.Header, fetchReq.Header)
+			response_cache.CopyHeader(resumeReq.Header, rangeHeaders)
+			return server.Proxy.Forward(ctx, &resumeReq)
+		})
+		if rule.Rewrite != nil && res.StatusCode == http.StatusOK {
+			rule.Rewrite(req, res, func(otherReq *http.Request) (*http.Response, error) {
+				return server.Proxy.Forward(ctx, otherReq)
+			})
+		}
+		return cancelOnClose(res, cancel), nil
 	})
 
-	server.Proxy.CopyResponse(rw, res)
+	response_cache.CopyHeader(req.Header, conditionalHeaders)
+	if res == nil {
+		upstreamError(rw, req, err)
+	} else if !response_cache.ServeConditional(rw, req, res) {
+		server.Proxy.CopyResponse(rw, res)
+	}
 
-	if err == response_cache.Uncacheable {
+	if err == response_cache.ServedStale {
+		fmt.Fprintf(os.Stdout, "%s request to %s served stale from cache, couldn't refresh\n", req.Method, req.URL)
+	} else if err == response_cache.Uncacheable {
 		fmt.Fprintf(os.Stdout, "%s request to %s was not actually cacheable, status %d\n", req.Method, req.URL, res.StatusCode)
+	} else if err == response_cache.LowDiskSpace {
+		fmt.Fprintf(os.Stdout, "%s request to %s not saved to cache, low disk space\n", req.Method, req.URL)
 	} else if err != nil {
 		fmt.Fprintf(os.Stdout, "%s request to %s failed, error %s\n", req.Method, req.URL, err)
+	} else if notModified {
+		fmt.Fprintf(os.Stdout, "%s request to %s revalidated and served from cache\n", req.Method, req.URL)
 	} else if forwarded {
 		fmt.Fprintf(os.Stdout, "%s request to %s saved to cache\n", req.Method, req.URL)
 	} else {
@@ -82,6 +154,118 @@ func (server proximateServer) serveCacheableRequest(rw http.ResponseWriter, req
 	}
 }
 
+// cancellingBody cancels the context used to fetch the response when the body is closed.
+type cancellingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func cancelOnClose(res *http.Response, cancel context.CancelFunc) *http.Response {
+	res.Body = cancellingBody{ReadCloser: res.Body, cancel: cancel}
+	return res
+}
+
+func (body cancellingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// followRedirects fetches the targets of redirect responses, so that we cache the content rather
+// than a redirect that may only be valid for a short time, and updates req to be the request for
+// the final response.  credentials for the original server aren't sent to other servers.
+func (server proximateServer) followRedirects(ctx context.Context, req *http.Request, res *http.Response) (*http.Response, error) {
+	for redirects := 0; redirects < MaxRedirects; redirects++ {
+		if res.StatusCode < 300 || res.StatusCode >= 400 || res.StatusCode == http.StatusNotModified {
+			return res, nil
+		}
+		location, err := res.Location()
+		if err != nil {
+			return res, nil
+		}
+		res.Body.Close()
+
+		if location.Host != req.URL.Host {
+			header := make(http.Header)
+			response_cache.CopyHeader(header, req.Header)
+			header.Del("Authorization")
+			req.Header = header
+		}
+		req.URL = location
+		req.Host = location.Host
+
+		res, err = server.Proxy.Forward(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// aliasLegacyEntry lets us serve the response cached under the key format used before rules had
+// key settings, if there is one, and returns true if there was.  it's only needed when there's
+// no entry under the current key format.
+func (server proximateServer) aliasLegacyEntry(req *http.Request, rule *response_cache.CacheRule, hash string) bool {
+	if legacyHash, err := rule.LegacyKey(req); err == nil && legacyHash != "" {
+		aliased, _ := server.Cache.Alias(legacyHash, hash)
+		return aliased
+	}
+	return false
+}
+
+// serveCachedHead answers HEAD requests from the cached GET response, if there is one.  we don't
+// want to fetch the whole response just to answer a HEAD request, so if there isn't, we pass the
+// request upstream.
+func (server proximateServer) serveCachedHead(rw http.ResponseWriter, req *http.Request, rule *response_cache.CacheRule, conditionalHeaders http.Header) {
+	getReq := *req
+	getReq.Method = "GET"
+	hash, err := rule.Key(&getReq)
+	if err != nil {
+		http.Error(rw, err.Error(), 401)
+		return
+	}
+
+	res, err := server.Cache.Lookup(hash, rule.TTL.Duration)
+	if os.IsNotExist(err) && server.aliasLegacyEntry(&getReq, rule, hash) {
+		res, err = server.Cache.Lookup(hash, rule.TTL.Duration)
+	}
+	response_cache.CopyHeader(req.Header, conditionalHeaders)
+	if err != nil {
+		server.proxyRequest(rw, req)
+		return
+	}
+
+	if !response_cache.ServeConditional(rw, req, res) {
+		// we couldn't tell the length of the response, so we can't use ServeContent
+		response_cache.CopyHeader(rw.Header(), res.Header)
+		rw.WriteHeader(res.StatusCode)
+		res.Body.Close()
+	}
+	fmt.Fprintf(os.Stdout, "%s request to %s served from cache\n", req.Method, req.URL)
+}
+
+// proxyRequest passes the request upstream without caching the response.
+func (server proximateServer) proxyRequest(rw http.ResponseWriter, req *http.Request) {
+	res, err := server.Proxy.Forward(server.Proxy.CancelContext(rw, req), req)
+	if err != nil {
+		upstreamError(rw, req, err)
+		fmt.Fprintf(os.Stdout, "%s request to %s failed, error %s\n", req.Method, req.URL, err)
+		return
+	}
+	server.Proxy.CopyResponse(rw, res)
+}
+
+// upstreamError responds with a 504 if the upstream server timed out, or a 502 if we couldn't get
+// a response from it for any other reason.
+func upstreamError(rw http.ResponseWriter, req *http.Request, err error) {
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(rw, fmt.Sprintf("Couldn't get a response for %s from the upstream server: %s", req.URL, err), status)
+}
+
 func (server proximateServer) extractHostFromPrefix(req *http.Request) {
 	req.URL.Scheme = "https"
 	parts := strings.SplitN(req.URL.Path, "/", 3)
@@ -93,18 +277,25 @@ func (server proximateServer) extractHostFromPrefix(req *http.Request) {
 func (server proximateServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	logger := &responseLogger{w: w, req: req}
 
-	// proxy-mode requests will have a full URL in the request path, with the Host populated;
-	// we don't need to touch those.  get-mode requests we move the first bit of the path down
-	// to be the host.
-	if req.URL.Host == "" {
-		server.extractHostFromPrefix(req)
-	}
+	// the rules may replace the request body with a copy spooled to a temporary file, which the
+	// server won't know to close
+	defer func() { req.Body.Close() }()
 
-	if (cachableGitPackRequest(req) && server.GitPackUpstreams.UpstreamListed(req.URL)) ||
-		(cacheableDebPoolRequest(req) && server.DebPoolUpstreams.UpstreamListed(req.URL)) {
-		server.serveCacheableRequest(logger, req)
+	if req.Method == "CONNECT" {
+		server.serveTunnel(logger, req)
 	} else {
-		server.Proxy.ServeHTTP(logger, req)
+		// proxy-mode requests will have a full URL in the request path, with the Host populated;
+		// we don't need to touch those.  get-mode requests we move the first bit of the path down
+		// to be the host.
+		if req.URL.Host == "" {
+			server.extractHostFromPrefix(req)
+		}
+
+		if rule := server.Rules.Match(req); rule != nil {
+			server.serveCacheableRequest(logger, req, rule)
+		} else {
+			server.proxyRequest(logger, req)
+		}
 	}
 
 	if !server.Quiet && server.Active() {
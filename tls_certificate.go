@@ -0,0 +1,111 @@
+package main
+
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "sync"
+import "time"
+
+// reloadingCertificate serves the certificate from a pair of files, loading it again when the
+// files change, so that renewed certificates are picked up without restarting.
+type reloadingCertificate struct {
+	certFile    string
+	keyFile     string
+	quiet       bool
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time
+	checked     time.Time
+}
+
+func newReloadingCertificate(certFile string, keyFile string, quiet bool) (*reloadingCertificate, error) {
+	reloading := &reloadingCertificate{certFile: certFile, keyFile: keyFile, quiet: quiet}
+	if err := reloading.load(); err != nil {
+		return nil, err
+	}
+	return reloading, nil
+}
+
+func (reloading *reloadingCertificate) load() error {
+	modified, err := reloading.lastModified()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(reloading.certFile, reloading.keyFile)
+	if err != nil {
+		return err
+	}
+	reloading.certificate = &certificate
+	reloading.modified = modified
+	return nil
+}
+
+// lastModified returns the latest modification time of the two files.
+func (reloading *reloadingCertificate) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, filename := range []string{reloading.certFile, reloading.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+// GetCertificate returns the current certificate.  we check whether the files have changed at most
+// every TLSReloadCheckInterval seconds; if they have but can't be loaded, for example because
+// only one of them has been replaced so far, we keep using the old certificate and try again later.
+func (reloading *reloadingCertificate) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloading.mutex.Lock()
+	defer reloading.mutex.Unlock()
+
+	if time.Since(reloading.checked) < TLSReloadCheckInterval*time.Second {
+		return reloading.certificate, nil
+	}
+	reloading.checked = time.Now()
+
+	if modified, err := reloading.lastModified(); err == nil && !modified.Equal(reloading.modified) {
+		if err := reloading.load(); err != nil {
+			fmt.Fprintf(os.Stdout, "couldn't reload TLS certificate %s: %s\n", reloading.certFile, err)
+		} else if !reloading.quiet {
+			fmt.Fprintf(os.Stdout, "reloaded TLS certificate %s\n", reloading.certFile)
+		}
+	}
+	return reloading.certificate, nil
+}
+
+// ServerTLSConfig returns the TLS configuration for serving requests using the certificate in the
+// given files, which will be reloaded if they change.  if a client CA file is given, clients must
+// present a certificate signed by one of the CAs in it.
+func ServerTLSConfig(certFile string, keyFile string, clientCAFile string, quiet bool) (*tls.Config, error) {
+	reloading, err := newReloadingCertificate(certFile, keyFile, quiet)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate: reloading.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
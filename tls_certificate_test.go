@@ -0,0 +1,164 @@
+package main
+
+import "testing"
+
+import "bytes"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "io/ioutil"
+import "math/big"
+import "os"
+import "path/filepath"
+import "time"
+
+// testCertificatePair makes a self-signed certificate, returning the PEM-encoded certificate and
+// key, and the DER-encoded certificate to compare against.
+func testCertificatePair(t *testing.T, name string) ([]byte, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		der
+}
+
+// writeTestFile writes the file and gives it the modification time, since files written in quick
+// succession may otherwise have the same time.
+func writeTestFile(t *testing.T, filename string, data []byte, modified time.Time) {
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertServingCertificate(t *testing.T, reloading *reloadingCertificate, expected []byte, description string) {
+	// don't wait for the check interval
+	reloading.checked = time.Time{}
+	certificate, err := reloading.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(certificate.Certificate[0], expected) {
+		t.Errorf("expected %s", description)
+	}
+}
+
+func TestReloadingCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proximate-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	oldCert, oldKey, oldDER := testCertificatePair(t, "old.example.com")
+	modified := time.Now().Add(-time.Hour)
+	writeTestFile(t, certFile, oldCert, modified)
+	writeTestFile(t, keyFile, oldKey, modified)
+
+	reloading, err := newReloadingCertificate(certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertServingCertificate(t, reloading, oldDER, "the certificate to be loaded")
+
+	// if only one of the files has been replaced so far, they don't match, so keep the old one
+	newCert, newKey, newDER := testCertificatePair(t, "new.example.com")
+	writeTestFile(t, certFile, newCert, modified.Add(time.Minute))
+	assertServingCertificate(t, reloading, oldDER, "the old certificate to be kept until both files are replaced")
+
+	// and once both have been, use the new one
+	writeTestFile(t, keyFile, newKey, modified.Add(2*time.Minute))
+	assertServingCertificate(t, reloading, newDER, "the new certificate to be loaded once both files are replaced")
+}
+
+func TestReloadingCertificateChecksPeriodically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proximate-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	oldCert, oldKey, oldDER := testCertificatePair(t, "old.example.com")
+	modified := time.Now().Add(-time.Hour)
+	writeTestFile(t, certFile, oldCert, modified)
+	writeTestFile(t, keyFile, oldKey, modified)
+
+	reloading, err := newReloadingCertificate(certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertServingCertificate(t, reloading, oldDER, "the certificate to be loaded")
+
+	// we've just checked, so we don't look at the files again yet
+	newCert, newKey, newDER := testCertificatePair(t, "new.example.com")
+	writeTestFile(t, certFile, newCert, modified.Add(time.Minute))
+	writeTestFile(t, keyFile, newKey, modified.Add(time.Minute))
+	if certificate, _ := reloading.GetCertificate(nil); !bytes.Equal(certificate.Certificate[0], oldDER) {
+		t.Error("expected the files not to be checked again until the check interval has passed")
+	}
+	assertServingCertificate(t, reloading, newDER, "the new certificate to be loaded after the check interval")
+
+	// files that have disappeared are treated as not having changed
+	os.Remove(keyFile)
+	assertServingCertificate(t, reloading, newDER, "the certificate to be kept if the files can't be checked")
+}
+
+func TestServerTLSConfigClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proximate-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+
+	cert, key, _ := testCertificatePair(t, "proximate.example.com")
+	writeTestFile(t, certFile, cert, time.Now())
+	writeTestFile(t, keyFile, key, time.Now())
+
+	config, err := ServerTLSConfig(certFile, keyFile, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert || config.ClientCAs != nil {
+		t.Error("expected client certificates not to be required without a client CA file")
+	}
+
+	writeTestFile(t, caFile, []byte("not a certificate"), time.Now())
+	if _, err := ServerTLSConfig(certFile, keyFile, caFile, true); err == nil {
+		t.Error("expected an error for a client CA file with no certificates")
+	}
+
+	writeTestFile(t, caFile, cert, time.Now())
+	config, err = ServerTLSConfig(certFile, keyFile, caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Error("expected client certificates to be required with a client CA file")
+	}
+}
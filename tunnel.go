@@ -0,0 +1,102 @@
+package main
+
+import "fmt"
+import "io"
+import "net"
+import "net/http"
+import "os"
+import "path"
+import "strings"
+import "time"
+
+// TunnelAllowlist is a list of host:port patterns that clients may open CONNECT tunnels to.  hosts
+// may contain * wildcards, and the port may be *.
+type TunnelAllowlist []string
+
+func NewTunnelAllowlist(list string) TunnelAllowlist {
+	var allowlist TunnelAllowlist
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(pattern); err != nil {
+			pattern = net.JoinHostPort(strings.Trim(pattern, "[]"), "443")
+		}
+		allowlist = append(allowlist, pattern)
+	}
+	return allowlist
+}
+
+func (allowlist TunnelAllowlist) Allowed(hostport string) bool {
+	host, port, err := net.SplitHostPort(strings.ToLower(hostport))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowlist {
+		patternHost, patternPort, _ := net.SplitHostPort(pattern)
+		if matched, _ := path.Match(patternHost, host); matched && (patternPort == "*" || patternPort == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTunnel handles CONNECT requests by connecting to the requested server and passing data back
+// and forth without looking at it, so nothing sent through the tunnel is cached - unless we've
+// been given a CA to intercept tunnels to the servers listed in the cache rules.
+func (server proximateServer) serveTunnel(rw http.ResponseWriter, req *http.Request) {
+	if server.shouldIntercept(req.Host) {
+		server.interceptTunnel(rw, req)
+		return
+	}
+
+	if !server.Tunnels.Allowed(req.Host) {
+		http.Error(rw, fmt.Sprintf("Tunnels to %s are not allowed", req.Host), http.StatusForbidden)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", req.Host, ProxyTimeout*time.Second)
+	if err != nil {
+		upstreamError(rw, req, err)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "Tunnels aren't supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "couldn't take over connection for tunnel to %s: %s\n", req.Host, err)
+		return
+	}
+	defer client.Close()
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// the client may have sent the start of its TLS handshake along with the CONNECT request, so
+	// read from the buffer rather than the connection
+	done := make(chan struct{}, 2)
+	go splice(upstream, buffered, done)
+	go splice(client, upstream, done)
+	<-done
+	<-done
+}
+
+// splice copies from src to dst until src is closed, then closes the writing half of dst to let
+// the other end know.
+func splice(dst net.Conn, src io.Reader, done chan<- struct{}) {
+	io.Copy(dst, src)
+	// both TCP and TLS connections can be half-closed
+	if conn, ok := dst.(interface{ CloseWrite() error }); ok {
+		conn.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	done <- struct{}{}
+}
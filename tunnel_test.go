@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+import "reflect"
+
+func TestNewTunnelAllowlist(t *testing.T) {
+	for list, expected := range map[string]TunnelAllowlist{
+		"":                                nil,
+		"github.com":                      {"github.com:443"},
+		" GitHub.com , *.github.com:8443": {"github.com:443", "*.github.com:8443"},
+		"example.com:*,,":                 {"example.com:*"},
+		"[::1]:443,[::1],::1":             {"[::1]:443", "[::1]:443", "[::1]:443"},
+	} {
+		if allowlist := NewTunnelAllowlist(list); !reflect.DeepEqual(allowlist, expected) {
+			t.Errorf("expected %q to give %q, got %q", list, expected, allowlist)
+		}
+	}
+}
+
+func TestTunnelAllowlistAllowed(t *testing.T) {
+	allowlist := NewTunnelAllowlist("*.github.com,example.com:*,localhost:8443")
+
+	for hostport, expected := range map[string]bool{
+		"api.github.com:443":  true,
+		"API.GitHub.com:443":  true,
+		"api.github.com:80":   false,
+		"github.com:443":      false,
+		"evilgithub.com:443":  false,
+		"example.com:443":     true,
+		"example.com:22":      true,
+		"www.example.com:443": false,
+		"localhost:8443":      true,
+		"localhost:443":       false,
+		"api.github.com":      false,
+		"":                    false,
+	} {
+		if allowlist.Allowed(hostport) != expected {
+			t.Errorf("expected Allowed(%q) to be %v", hostport, expected)
+		}
+	}
+
+	if NewTunnelAllowlist("").Allowed("github.com:443") {
+		t.Error("expected an empty allowlist to allow nothing")
+	}
+}